@@ -1,10 +1,23 @@
 package geoip
 
 import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
+// default mmdb path is relative to working directory of kone
+func TestMain(m *testing.M) {
+	if err := OpenCountryDB("../mmdbs/GeoLite2-Country.mmdb"); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
 var cases = map[string]string{
 	"1.208.0.0":       "KR",
 	"114.114.114.114": "CN",
@@ -40,3 +53,152 @@ func BenchmarkQuery(b *testing.B) {
 		QueryCountry(i)
 	}
 }
+
+// minimal mmdb encoder for ipv4 database of 24 bits records
+type mmdbBuilder struct {
+	nodes [][2]int // record: >0 node, 0 empty, <0 data -(index+1)
+	data  bytes.Buffer
+	offs  []int // data offset of entries
+}
+
+// size less than 285
+func mmdbControl(buf *bytes.Buffer, typ int, size int) {
+	extra := -1
+	if size >= 29 {
+		size, extra = 29, size-29
+	}
+	if typ <= 7 {
+		buf.WriteByte(byte(typ<<5 | size))
+	} else {
+		buf.WriteByte(byte(size))
+		buf.WriteByte(byte(typ - 7))
+	}
+	if extra >= 0 {
+		buf.WriteByte(byte(extra))
+	}
+}
+
+func mmdbEncode(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case string:
+		mmdbControl(buf, 2, len(v))
+		buf.WriteString(v)
+	case uint16, uint32:
+		var n uint32
+		typ := 6
+		if x, ok := v.(uint16); ok {
+			n, typ = uint32(x), 5
+		} else {
+			n = v.(uint32)
+		}
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], n)
+		i := 0
+		for i < 4 && b[i] == 0 {
+			i++
+		}
+		mmdbControl(buf, typ, 4-i)
+		buf.Write(b[i:])
+	case map[string]interface{}:
+		mmdbControl(buf, 7, len(v))
+		for key, val := range v {
+			mmdbEncode(buf, key)
+			mmdbEncode(buf, val)
+		}
+	}
+}
+
+func (b *mmdbBuilder) insert(cidr string, v map[string]interface{}) {
+	_, ipNet, _ := net.ParseCIDR(cidr)
+	ones, _ := ipNet.Mask.Size()
+	ip := ipNet.IP.To4()
+
+	b.offs = append(b.offs, b.data.Len())
+	mmdbEncode(&b.data, v)
+	if len(b.nodes) == 0 {
+		b.nodes = append(b.nodes, [2]int{})
+	}
+
+	node := 0
+	for i := 0; i < ones; i++ {
+		bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+		if i == ones-1 {
+			b.nodes[node][bit] = -len(b.offs)
+			break
+		}
+		if b.nodes[node][bit] <= 0 {
+			b.nodes = append(b.nodes, [2]int{})
+			b.nodes[node][bit] = len(b.nodes) - 1
+		}
+		node = b.nodes[node][bit]
+	}
+}
+
+func (b *mmdbBuilder) bytes() []byte {
+	var buf bytes.Buffer
+	count := len(b.nodes)
+	for _, node := range b.nodes {
+		for _, r := range node {
+			v := count // empty
+			if r > 0 {
+				v = r
+			} else if r < 0 {
+				v = count + 16 + b.offs[-r-1]
+			}
+			buf.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	}
+	buf.Write(make([]byte, 16))
+	buf.Write(b.data.Bytes())
+	buf.WriteString("\xab\xcd\xefMaxMind.com")
+	mmdbEncode(&buf, map[string]interface{}{
+		"node_count":                  uint32(count),
+		"record_size":                 uint16(24),
+		"ip_version":                  uint16(4),
+		"database_type":               "GeoLite2-ASN",
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+	})
+	return buf.Bytes()
+}
+
+func TestQueryASN(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := new(mmdbBuilder)
+	b.insert("1.1.1.0/24", map[string]interface{}{
+		"autonomous_system_number":       uint32(13335),
+		"autonomous_system_organization": "CLOUDFLARENET",
+	})
+	b.insert("8.8.8.0/24", map[string]interface{}{
+		"autonomous_system_number":       uint32(15169),
+		"autonomous_system_organization": "GOOGLE",
+	})
+	path := filepath.Join(dir, "GeoLite2-ASN.mmdb")
+	if err := ioutil.WriteFile(path, b.bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := OpenASNDB(path); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { asndb = nil }()
+
+	if asn := QueryASNByIPDetails(net.ParseIP("1.1.1.1")); asn.AutonomousSystemNumber != 13335 || asn.AutonomousSystemOrganization != "CLOUDFLARENET" {
+		t.Errorf("1.1.1.1: %+v", asn)
+	}
+	cases := map[string]uint{
+		"8.8.4.4":     0,
+		"8.8.8.8":     15169,
+		"192.168.0.1": 0,
+		"2001:db8::1": 0,
+	}
+	for ip, expected := range cases {
+		if asn := QueryASNByIP(net.ParseIP(ip)); asn != expected {
+			t.Errorf("%s: %d, expected %d", ip, asn, expected)
+		}
+	}
+}
@@ -29,7 +29,10 @@ func QueryCountry(ip uint32) string {
 	return country
 }
 
-var mmdb *maxminddb.Reader
+var (
+	mmdb  *maxminddb.Reader
+	asndb *maxminddb.Reader // optional
+)
 
 func init() {
 	db, err := maxminddb.Open("mmdbs/GeoLite2-Country.mmdb")
@@ -37,17 +40,62 @@ func init() {
 		logger.Errorf("open maxminddb failed:%s", err.Error())
 	}
 	mmdb = db
+
+	if db, err := maxminddb.Open("mmdbs/GeoLite2-ASN.mmdb"); err == nil {
+		asndb = db
+	}
+}
+
+// replace the default country mmdb
+func OpenCountryDB(path string) error {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return err
+	}
+	mmdb = db
+	return nil
+}
+
+// open GeoLite2-ASN style mmdb, replace the default one
+func OpenASNDB(path string) error {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return err
+	}
+	asndb = db
+	return nil
 }
 
 func QueryConuntryByIPDetails(ip net.IP) GeoLite2Country {
 	record := make(map[string]interface{})
 	country := GeoLite2Country{}
 
+	if mmdb == nil {
+		return country
+	}
 	mmdb.Lookup(ip, &record)
 	mapstructure.Decode(record, &country)
 	return country
 }
 
+// zero value if not found or no ASN mmdb
+func QueryASNByIPDetails(ip net.IP) GeoLite2ASN {
+	var asn GeoLite2ASN
+	if asndb != nil {
+		asndb.Lookup(ip, &asn)
+	}
+	return asn
+}
+
+func QueryASNByIP(ip net.IP) uint {
+	return QueryASNByIPDetails(ip).AutonomousSystemNumber
+}
+
+type GeoLite2ASN struct {
+	AutonomousSystemNumber       uint   `json:"autonomous_system_number" maxminddb:"autonomous_system_number"`
+	AutonomousSystemOrganization string `json:"autonomous_system_organization" maxminddb:"autonomous_system_organization"`
+}
+
 func QueryCountryByIP(ip net.IP) string {
 	ip = ip.To4()
 	if ip == nil {
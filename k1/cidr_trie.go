@@ -0,0 +1,256 @@
+package k1
+
+import (
+	"net"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// node of path compressed binary trie, internal nodes always have two children
+type cidrNode struct {
+	ip    net.IP // masked prefix
+	bits  int    // prefix length
+	leaf  bool   // prefix is in the set, no children
+	child [2]*cidrNode
+}
+
+func bitAt(ip net.IP, i int) int {
+	return int(ip[i>>3]>>(7-uint(i&7))) & 1
+}
+
+// ip has prefix of the first bits of prefix
+func hasPrefix(ip, prefix net.IP, bits int) bool {
+	n := bits >> 3
+	for i := 0; i < n; i++ {
+		if ip[i] != prefix[i] {
+			return false
+		}
+	}
+	if rem := uint(bits & 7); rem > 0 {
+		mask := byte(0xff << (8 - rem))
+		return ip[n]&mask == prefix[n]&mask
+	}
+	return true
+}
+
+// length of common prefix, at most max bits
+func commonBits(a, b net.IP, max int) int {
+	for i := 0; i < max; i += 8 {
+		if x := a[i>>3] ^ b[i>>3]; x != 0 {
+			n := i
+			for x&0x80 == 0 {
+				x <<= 1
+				n++
+			}
+			if n > max {
+				return max
+			}
+			return n
+		}
+	}
+	return max
+}
+
+func maskIP(ip net.IP, bits int) net.IP {
+	return ip.Mask(net.CIDRMask(bits, len(ip)*8))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func newCidrLeaf(ip net.IP, bits int) *cidrNode {
+	return &cidrNode{ip: maskIP(ip, bits), bits: bits, leaf: true}
+}
+
+// two halves of a prefix merge into it
+func (n *cidrNode) merge() *cidrNode {
+	l, r := n.child[0], n.child[1]
+	if l != nil && r != nil && l.leaf && r.leaf && l.bits == n.bits+1 && r.bits == n.bits+1 {
+		return newCidrLeaf(n.ip, n.bits)
+	}
+	return n
+}
+
+// internal node with one child is replaced by the child
+func (n *cidrNode) compact() *cidrNode {
+	if n.leaf {
+		return n
+	}
+	switch {
+	case n.child[0] == nil:
+		return n.child[1]
+	case n.child[1] == nil:
+		return n.child[0]
+	}
+	return n
+}
+
+func cidrInsert(n *cidrNode, ip net.IP, bits int) *cidrNode {
+	if n == nil {
+		return newCidrLeaf(ip, bits)
+	}
+
+	common := commonBits(n.ip, ip, minInt(n.bits, bits))
+	if common == bits {
+		// new prefix covers n
+		if n.bits == bits && n.leaf {
+			return n
+		}
+		return newCidrLeaf(ip, bits)
+	}
+	if common < n.bits {
+		// diverge from n, split at common prefix
+		parent := &cidrNode{ip: maskIP(ip, common), bits: common}
+		parent.child[bitAt(n.ip, common)] = n
+		parent.child[bitAt(ip, common)] = newCidrLeaf(ip, bits)
+		return parent.merge()
+	}
+
+	// n is an ancestor of new prefix
+	if n.leaf {
+		return n
+	}
+	b := bitAt(ip, n.bits)
+	n.child[b] = cidrInsert(n.child[b], ip, bits)
+	return n.merge()
+}
+
+func cidrRemove(n *cidrNode, ip net.IP, bits int) *cidrNode {
+	if n == nil {
+		return nil
+	}
+
+	common := commonBits(n.ip, ip, minInt(n.bits, bits))
+	if common < minInt(n.bits, bits) {
+		// disjoint
+		return n
+	}
+	if bits <= n.bits {
+		// removed prefix covers n
+		return nil
+	}
+
+	// n is an ancestor of removed prefix
+	if n.leaf {
+		// split leaf into the rest of it
+		var rest *cidrNode
+		for d := n.bits; d < bits; d++ {
+			sibling := maskIP(ip, d+1)
+			sibling[d>>3] ^= 0x80 >> uint(d&7)
+			rest = cidrInsert(rest, sibling, d+1)
+		}
+		return rest
+	}
+	b := bitAt(ip, n.bits)
+	n.child[b] = cidrRemove(n.child[b], ip, bits)
+	return n.compact()
+}
+
+func cidrContains(n *cidrNode, ip net.IP) bool {
+	for n != nil {
+		if !hasPrefix(ip, n.ip, n.bits) {
+			return false
+		}
+		if n.leaf {
+			return true
+		}
+		n = n.child[bitAt(ip, n.bits)]
+	}
+	return false
+}
+
+func cidrWalk(n *cidrNode, f func(*cidrNode)) {
+	if n == nil {
+		return
+	}
+	if n.leaf {
+		f(n)
+		return
+	}
+	cidrWalk(n.child[0], f)
+	cidrWalk(n.child[1], f)
+}
+
+// set of IPv4 and IPv6 networks, overlapped and adjacent networks are merged
+type CIDRTrie struct {
+	v4 *cidrNode
+	v6 *cidrNode
+}
+
+func (t *CIDRTrie) root(ip net.IP) (**cidrNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &t.v4, ip4
+	}
+	return &t.v6, ip.To16()
+}
+
+func ipNetBits(ipNet *net.IPNet, ip net.IP) int {
+	ones, bits := ipNet.Mask.Size()
+	// IPv4 network in 16 bytes form
+	return ones - (bits - len(ip)*8)
+}
+
+func (t *CIDRTrie) Insert(ipNet *net.IPNet) {
+	root, ip := t.root(ipNet.IP)
+	if ip == nil {
+		return
+	}
+	*root = cidrInsert(*root, ip, ipNetBits(ipNet, ip))
+}
+
+// remove network from the set, the rest of a larger network is kept
+func (t *CIDRTrie) Remove(ipNet *net.IPNet) {
+	root, ip := t.root(ipNet.IP)
+	if ip == nil {
+		return
+	}
+	*root = cidrRemove(*root, ip, ipNetBits(ipNet, ip))
+}
+
+func (t *CIDRTrie) Contains(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		return cidrContains(t.v4, ip4)
+	}
+	if len(ip) != net.IPv6len {
+		return false
+	}
+	return cidrContains(t.v6, ip)
+}
+
+func (t *CIDRTrie) ContainsUint32(v uint32) bool {
+	ip := [4]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+	return cidrContains(t.v4, ip[:])
+}
+
+// count of merged networks
+func (t *CIDRTrie) Len() int {
+	n := 0
+	f := func(*cidrNode) { n++ }
+	cidrWalk(t.v4, f)
+	cidrWalk(t.v6, f)
+	return n
+}
+
+// merged networks, IPv4 first
+func (t *CIDRTrie) CIDRs() []*net.IPNet {
+	var ipNets []*net.IPNet
+	f := func(n *cidrNode) {
+		ipNets = append(ipNets, &net.IPNet{IP: n.ip, Mask: net.CIDRMask(n.bits, len(n.ip)*8)})
+	}
+	cidrWalk(t.v4, f)
+	cidrWalk(t.v6, f)
+	return ipNets
+}
+
+func (t *CIDRTrie) MarshalJSON() ([]byte, error) {
+	ipNets := t.CIDRs()
+	vals := make([]string, 0, len(ipNets))
+	for _, ipNet := range ipNets {
+		vals = append(vals, ipNet.String())
+	}
+	return jsoniter.Marshal(vals)
+}
@@ -0,0 +1,178 @@
+package k1
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func newTestCIDRTrie(t testing.TB, cidrs ...string) *CIDRTrie {
+	trie := new(CIDRTrie)
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trie.Insert(ipNet)
+	}
+	return trie
+}
+
+func checkCIDRs(t *testing.T, trie *CIDRTrie, expected ...string) {
+	cidrs := trie.CIDRs()
+	if len(cidrs) != len(expected) {
+		t.Fatalf("cidrs: %v, expected: %v", cidrs, expected)
+	}
+	for i, ipNet := range cidrs {
+		if ipNet.String() != expected[i] {
+			t.Fatalf("cidrs: %v, expected: %v", cidrs, expected)
+		}
+	}
+}
+
+func TestCIDRTrieMerge(t *testing.T) {
+	// adjacent halves
+	checkCIDRs(t, newTestCIDRTrie(t, "10.0.0.0/25", "10.0.0.128/25"), "10.0.0.0/24")
+	checkCIDRs(t, newTestCIDRTrie(t, "10.0.0.0/26", "10.0.0.64/26", "10.0.0.128/25"), "10.0.0.0/24")
+
+	// covered
+	checkCIDRs(t, newTestCIDRTrie(t, "10.0.0.0/16", "10.0.1.0/24"), "10.0.0.0/16")
+	checkCIDRs(t, newTestCIDRTrie(t, "10.0.1.0/24", "10.0.3.0/24", "10.0.0.0/16"), "10.0.0.0/16")
+
+	checkCIDRs(t, newTestCIDRTrie(t, "172.16.0.1/32", "10.0.0.0/8", "2001:db8::/32", "::ffff:192.168.0.0/112"),
+		"10.0.0.0/8", "172.16.0.1/32", "192.168.0.0/16", "2001:db8::/32")
+}
+
+func TestCIDRTrieRemove(t *testing.T) {
+	trie := newTestCIDRTrie(t, "10.0.0.0/22", "2001:db8::/32")
+
+	_, ipNet, _ := net.ParseCIDR("10.0.1.0/24")
+	trie.Remove(ipNet)
+	checkCIDRs(t, trie, "10.0.0.0/24", "10.0.2.0/23", "2001:db8::/32")
+
+	trie.Insert(ipNet)
+	checkCIDRs(t, trie, "10.0.0.0/22", "2001:db8::/32")
+
+	_, ipNet, _ = net.ParseCIDR("2001:db8::/32")
+	trie.Remove(ipNet)
+	checkCIDRs(t, trie, "10.0.0.0/22")
+
+	// remove a larger network
+	_, ipNet, _ = net.ParseCIDR("10.0.0.0/8")
+	trie.Remove(ipNet)
+	if trie.Len() != 0 {
+		t.Fatalf("cidrs: %v", trie.CIDRs())
+	}
+}
+
+func TestCIDRTrieContains(t *testing.T) {
+	trie := newTestCIDRTrie(t, "0.0.0.0/1", "2001:db8::/32")
+
+	cases := map[string]bool{
+		"127.255.255.255":        true,
+		"128.0.0.0":              false,
+		"::ffff:1.2.3.4":         true,
+		"2001:db8:ffff::1":       true,
+		"2001:db9::1":            false,
+		"::1":                    false,
+		"ffff:ffff:ffff::ffff:1": false,
+	}
+	for ip, expected := range cases {
+		if trie.Contains(net.ParseIP(ip)) != expected {
+			t.Errorf("contains %s, expected %v", ip, expected)
+		}
+	}
+	if !trie.ContainsUint32(0x7fffffff) || trie.ContainsUint32(0x80000000) {
+		t.Error("contains uint32 failed")
+	}
+}
+
+func randomIPNet(r *rand.Rand, size int, minBits, maxBits int) *net.IPNet {
+	ip := make(net.IP, size)
+	r.Read(ip)
+	bits := minBits + r.Intn(maxBits-minBits+1)
+	mask := net.CIDRMask(bits, size*8)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// compare with applying all operations in order
+func TestCIDRTrieRandom(t *testing.T) {
+	type op struct {
+		ipNet  *net.IPNet
+		insert bool
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for _, size := range []int{net.IPv4len, net.IPv6len} {
+		trie := new(CIDRTrie)
+		var ops []op
+		for i := 0; i < 2000; i++ {
+			// short prefixes of a small space overlap a lot
+			ipNet := randomIPNet(r, size, 4, 12)
+			insert := i%4 != 3
+			if insert {
+				trie.Insert(ipNet)
+			} else {
+				trie.Remove(ipNet)
+			}
+			ops = append(ops, op{ipNet, insert})
+		}
+
+		for i := 0; i < 10000; i++ {
+			ip := make(net.IP, size)
+			r.Read(ip)
+			if size == net.IPv6len && ip.To4() != nil {
+				continue
+			}
+			expected := false
+			for _, o := range ops {
+				if o.ipNet.Contains(ip) {
+					expected = o.insert
+				}
+			}
+			if trie.Contains(ip) != expected {
+				t.Fatalf("contains %s, expected %v", ip, expected)
+			}
+		}
+	}
+}
+
+func BenchmarkCIDRTrieInsert(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	ipNets := make([]*net.IPNet, 10000)
+	for i := range ipNets {
+		ipNets[i] = randomIPNet(r, 4, 12, 24)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie := new(CIDRTrie)
+		for _, ipNet := range ipNets {
+			trie.Insert(ipNet)
+		}
+	}
+}
+
+// size of a country ip list
+func BenchmarkCIDRTrieContains(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	trie := new(CIDRTrie)
+	for i := 0; i < 10000; i++ {
+		trie.Insert(randomIPNet(r, 4, 12, 24))
+		trie.Insert(randomIPNet(r, 16, 20, 48))
+	}
+	ips := make([]net.IP, 1024)
+	for i := range ips {
+		if i%2 == 0 {
+			ips[i] = make(net.IP, 4)
+		} else {
+			ips[i] = make(net.IP, 16)
+		}
+		r.Read(ips[i])
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.Contains(ips[i%len(ips)])
+	}
+}
@@ -3,6 +3,7 @@ package k1
 import (
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 
 	"gopkg.in/gcfg.v1"
@@ -10,6 +11,8 @@ import (
 
 type GeneralConfig struct {
 	Network string // tun network
+	AsnDb   string `gcfg:"asn-db"`  // GeoLite2-ASN style mmdb for IP-ASN patterns
+	GeoSite string `gcfg:"geosite"` // v2fly geosite.dat for GEOSITE patterns
 }
 
 type NatConfig struct {
@@ -25,6 +28,57 @@ type DnsConfig struct {
 	DnsReadTimeout  uint     `gcfg:"dns-read-timeout"`
 	DnsWriteTimeout uint     `gcfg:"dns-write-timeout"`
 	Nameserver      []string // backend dns
+
+	UpstreamStrategy string `gcfg:"upstream-strategy"` // how to pick backend dns
+
+	Intercept bool // intercept dns queries to any resolver through tun
+
+	// how to get the real ip of proxy domains: local, remote or none
+	ProxyResolve    string   `gcfg:"proxy-resolve"`
+	ProxyNameserver []string `gcfg:"proxy-nameserver"` // dns used through proxy when proxy-resolve = remote
+
+	CacheFile   string `gcfg:"cache-file"`    // keep hijacked domain records across restarts
+	FakeIPSpace uint32 `gcfg:"fake-ip-space"` // max count of fake ip allocated from network
+
+	// hijacked domain records idle longer than record-lifetime are released,
+	// checked every sweep-interval once there are sweep-threshold records
+	RecordLifetime uint `gcfg:"record-lifetime"`
+	SweepInterval  uint `gcfg:"sweep-interval"`
+	SweepThreshold uint `gcfg:"sweep-threshold"`
+
+	// domains never hijacked to fake ip
+	FakeIPFilterSuffix   []string `gcfg:"fake-ip-filter-suffix"`
+	FakeIPFilterKeyword  []string `gcfg:"fake-ip-filter-keyword"`
+	FakeIPFilterWildcard []string `gcfg:"fake-ip-filter-wildcard"`
+	FakeIPFilterPattern  []string `gcfg:"fake-ip-filter-pattern"` // name of pattern
+
+	// non A query of proxy domain
+	AAAAPolicy  string   `gcfg:"aaaa-policy"`
+	HTTPSPolicy string   `gcfg:"https-policy"`
+	BlockQtype  []string `gcfg:"block-qtype"`
+
+	// recent queries kept in memory, and optionally persisted as json lines
+	QueryLogSize   uint   `gcfg:"query-log-size"`
+	QueryLogFile   string `gcfg:"query-log-file"`
+	QueryLogMaxAge uint   `gcfg:"query-log-max-age"` // days
+
+	// filters of answers from backend dns
+	BogusNXDomain    []string `gcfg:"bogus-nxdomain"`
+	RebindProtection bool     `gcfg:"rebind-protection"`
+	RebindDomainOk   []string `gcfg:"rebind-domain-ok"`
+	MinTtl           uint     `gcfg:"min-ttl"`
+	StripType        []string `gcfg:"strip-type"`
+
+	// validate answers from backend dns, root zone ksk if no trust anchor
+	Dnssec      bool
+	TrustAnchor []string `gcfg:"trust-anchor"` // DS or DNSKEY record
+}
+
+// static dns records, answered before any rule
+type HostsConfig struct {
+	V    []string // `name value`, value is an ip or a cname
+	File []string // hosts file path
+	Ttl  uint
 }
 
 type RouteConfig struct {
@@ -34,21 +88,33 @@ type RouteConfig struct {
 type ProxyConfig struct {
 	Url     string
 	Default bool
+	Resolve string // override dns proxy-resolve for this proxy
 }
 
 // https://manual.nssurge.com/policy.html
 // There are 3 types of policies: PROXY, DIRECT and REJECT
 type PatternConfig struct {
-	Policy string
-	Proxy  string
-	Scheme string
-	V      []string
+	Policy   string
+	Proxy    string
+	Scheme   string
+	V        []string
+	Provider []string // name of rule providers, values are appended to V
+}
+
+// external rule list of patterns, a local file or url
+type ProviderConfig struct {
+	Url      string
+	Format   string // domain, cidr, hosts, clash or surge
+	Cache    string // keep the last fetched list of url
+	Interval uint   // refresh interval in seconds, file is never refreshed if 0
+	Proxy    string // fetch url through proxy
 }
 
 // There are 5 types of rules: DOMAIN, DOMAIN-SUFFIX, DOMAIN-KEYWORD, IP-COUNTRY and IP-CIDR
 type RuleConfig struct {
 	Pattern []string
 	Final   string
+	Overlay string // edits through api, replayed on start
 }
 
 type ManagerConfig struct {
@@ -56,15 +122,19 @@ type ManagerConfig struct {
 }
 
 type KoneConfig struct {
-	General GeneralConfig
-	TCP     NatConfig
-	UDP     NatConfig
-	Dns     DnsConfig
-	Route   RouteConfig
-	Proxy   map[string]*ProxyConfig
-	Pattern map[string]*PatternConfig
-	Rule    RuleConfig
-	Manager ManagerConfig
+	General  GeneralConfig
+	TCP      NatConfig
+	UDP      NatConfig
+	Dns      DnsConfig
+	Hosts    HostsConfig
+	Route    RouteConfig
+	Proxy    map[string]*ProxyConfig
+	Pattern  map[string]*PatternConfig
+	Provider map[string]*ProviderConfig
+	Rule     RuleConfig
+	Manager  ManagerConfig
+
+	file string // parsed from, read again on reload
 }
 
 func (cfg *KoneConfig) isValidProxy(proxy string) bool {
@@ -139,14 +209,51 @@ func (cfg *KoneConfig) checkRule() error {
 		}
 
 		for _, val := range patternConfig.V {
-			if scheme == schemeIPCIDR {
+			switch scheme {
+			case schemeIPCIDR, schemeSrcIPCIDR:
 				if _, _, err := net.ParseCIDR(val); err != nil {
 					return fmt.Errorf("[check pattern %q] invalid value: %s", name, val)
 				}
+			case schemeDomainWildcard:
+				if !isValidDomainWildcard(val) {
+					return fmt.Errorf("[check pattern %q] invalid wildcard: %s", name, val)
+				}
+			case schemeDomainRegex:
+				if _, err := compileDomainRegex(val); err != nil {
+					return fmt.Errorf("[check pattern %q] invalid regex: %s, %v", name, val, err)
+				}
+			case schemeDstPort:
+				if _, err := parsePortRange(val); err != nil {
+					return fmt.Errorf("[check pattern %q] invalid port: %s", name, val)
+				}
+			case schemeIPASN:
+				if _, err := parseASN(val); err != nil {
+					return fmt.Errorf("[check pattern %q] %v", name, err)
+				}
+			case schemeGeoSite:
+				if !isValidGeoSite(val) {
+					return fmt.Errorf("[check pattern %q] invalid geosite: %s", name, val)
+				}
+			case schemeProcessPath:
+				if !isValidProcessPath(val) {
+					return fmt.Errorf("[check pattern %q] invalid path: %s", name, val)
+				}
+			case schemeUID:
+				if _, err := parseUID(val); err != nil {
+					return fmt.Errorf("[check pattern %q] %v", name, err)
+				}
+			case schemeNetwork:
+				if !isValidNetwork(val) {
+					return fmt.Errorf("[check pattern %q] invalid network: %s", name, val)
+				}
 			}
 		}
 	}
 
+	if err := checkLogicalPatterns(patterns); err != nil {
+		return err
+	}
+
 	rule := cfg.Rule
 	for _, pattern := range rule.Pattern {
 		logger.Infof("[check rule] pattern: %s", pattern)
@@ -163,6 +270,46 @@ func (cfg *KoneConfig) checkRule() error {
 	return nil
 }
 
+// children of AND/OR/NOT patterns must exist and never refer back to the pattern
+func checkLogicalPatterns(patterns map[string]*PatternConfig) error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("[check pattern %q] cycle: %s", name, strings.Join(append(path, name), " -> "))
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		patternConfig := patterns[name]
+		if isLogicalScheme(patternConfig.Scheme) {
+			for _, child := range patternConfig.V {
+				if _, ok := patterns[child]; !ok {
+					return fmt.Errorf("[check pattern %q] invalid pattern: %q", name, child)
+				}
+				if err := visit(child, append(path, name)); err != nil {
+					return err
+				}
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+
+	for name := range patterns {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (cfg *KoneConfig) fixDns() error {
 	dns := cfg.Dns
 
@@ -181,6 +328,63 @@ func (cfg *KoneConfig) fixDns() error {
 		//}
 		dns.Nameserver[index] = server
 	}
+
+	// clients may still use a fake ip released before its answer expires
+	if dns.RecordLifetime < dns.DnsTtl {
+		logger.Warningf("[check dns] record-lifetime %d is less than dns-ttl %d, use %d", dns.RecordLifetime, dns.DnsTtl, dns.DnsTtl)
+		cfg.Dns.RecordLifetime = dns.DnsTtl
+	}
+
+	if dns.SweepInterval == 0 {
+		return fmt.Errorf("[check dns] invalid sweep-interval: %d", dns.SweepInterval)
+	}
+
+	if !isValidUpstreamStrategy(dns.UpstreamStrategy) {
+		return fmt.Errorf("[check dns] invalid upstream-strategy: %s", dns.UpstreamStrategy)
+	}
+
+	if !isValidProxyResolve(dns.ProxyResolve) {
+		return fmt.Errorf("[check dns] invalid proxy-resolve: %s", dns.ProxyResolve)
+	}
+
+	for name, proxy := range cfg.Proxy {
+		if proxy.Resolve != "" && !isValidProxyResolve(proxy.Resolve) {
+			return fmt.Errorf("[check dns] proxy %q invalid resolve: %s", name, proxy.Resolve)
+		}
+	}
+
+	if !isValidAAAAPolicy(dns.AAAAPolicy) {
+		return fmt.Errorf("[check dns] invalid aaaa-policy: %s", dns.AAAAPolicy)
+	}
+
+	if !isValidHTTPSPolicy(dns.HTTPSPolicy) {
+		return fmt.Errorf("[check dns] invalid https-policy: %s", dns.HTTPSPolicy)
+	}
+
+	for _, qtype := range dns.BlockQtype {
+		if _, err := parseQtype(qtype); err != nil {
+			return fmt.Errorf("[check dns] invalid block-qtype: %s", qtype)
+		}
+	}
+
+	if err := checkDnssec(dns); err != nil {
+		return err
+	}
+
+	if err := checkDnsFilters(dns); err != nil {
+		return err
+	}
+
+	if err := checkFakeIPFilter(dns, cfg.Pattern); err != nil {
+		return err
+	}
+
+	for index, nameserver := range dns.ProxyNameserver {
+		logger.Infof("[check dns] proxy nameserver: %s", nameserver)
+		if _, _, err := net.SplitHostPort(nameserver); err != nil {
+			dns.ProxyNameserver[index] = net.JoinHostPort(strings.Trim(nameserver, "[]"), strconv.Itoa(dnsDefaultPort))
+		}
+	}
 	return nil
 }
 
@@ -201,9 +405,17 @@ func (cfg *KoneConfig) check() (err error) {
 		return
 	}
 
+	if err = checkProviders(cfg); err != nil {
+		return
+	}
+
 	if err = cfg.fixDns(); err != nil {
 		return
 	}
+
+	if err = checkHosts(cfg.Hosts); err != nil {
+		return
+	}
 	return
 }
 
@@ -226,6 +438,18 @@ func ParseConfig(filename string) (*KoneConfig, error) {
 	cfg.Dns.DnsPacketSize = dnsDefaultPacketSize
 	cfg.Dns.DnsReadTimeout = dnsDefaultReadTimeout
 	cfg.Dns.DnsWriteTimeout = dnsDefaultWriteTimeout
+	cfg.Dns.UpstreamStrategy = upstreamStrategyOrdered
+	cfg.Dns.ProxyResolve = proxyResolveLocal
+	cfg.Dns.FakeIPSpace = DnsIPPoolMaxSpace
+	cfg.Dns.RecordLifetime = dnsDefaultRecordLifetime
+	cfg.Dns.SweepInterval = dnsDefaultSweepInterval
+	cfg.Dns.SweepThreshold = dnsDefaultSweepThreshold
+	cfg.Dns.AAAAPolicy = aaaaPolicyEmpty
+	cfg.Dns.HTTPSPolicy = httpsPolicyStrip
+	cfg.Dns.QueryLogSize = dnsQueryLogDefaultSize
+	cfg.Dns.QueryLogMaxAge = dnsQueryLogDefaultMaxAge
+
+	cfg.Hosts.Ttl = hostsDefaultTtl
 
 	// decode config value
 	err := gcfg.ReadFileInto(cfg, filename)
@@ -239,10 +463,15 @@ func ParseConfig(filename string) (*KoneConfig, error) {
 		cfg.Dns.Nameserver = append(cfg.Dns.Nameserver, "223.5.5.5")
 	}
 
+	if len(cfg.Dns.ProxyNameserver) == 0 {
+		cfg.Dns.ProxyNameserver = append(cfg.Dns.ProxyNameserver, "8.8.8.8")
+	}
+
 	err = cfg.check()
 	if err != nil {
 		return nil, err
 	}
 
+	cfg.file = filename
 	return cfg, nil
 }
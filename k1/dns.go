@@ -7,6 +7,7 @@ import (
 	"regexp"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -19,32 +20,121 @@ const (
 	dnsDefaultPacketSize   = 4096
 	dnsDefaultReadTimeout  = 5
 	dnsDefaultWriteTimeout = 5
+
+	dnsDefaultRecordLifetime = 600
+	dnsDefaultSweepInterval  = 60
+	dnsDefaultSweepThreshold = 1000
+)
+
+// how to get the real ip of a proxy domain
+const (
+	proxyResolveLocal  = "local"  // resolve by backend dns
+	proxyResolveRemote = "remote" // resolve by dns over tcp through the proxy
+	proxyResolveNone   = "none"   // don't resolve, leave it to the proxy
 )
 
 var resolveErr = errors.New("resolve error")
 
+func isValidProxyResolve(mode string) bool {
+	switch mode {
+	case proxyResolveLocal, proxyResolveRemote, proxyResolveNone:
+		return true
+	}
+	return false
+}
+
 type Dns struct {
 	one         *One
 	server      *dns.Server
+	tcpServer   *dns.Server // serve dns over tcp intercepted from tun
+	port        uint16
+	intercept   bool // intercept dns queries to any resolver through tun
 	clients     DnsClients
 	nameservers []string
+
+	proxyResolve     string
+	proxyNameservers []string
+	timeout          time.Duration
+
+	fakeIPFilter atomic.Value // *FakeIPFilter, swapped on reload
+	hosts        *Hosts
+
+	// non A query policy of proxy domain
+	aaaaPolicy  string
+	httpsPolicy string
+	blockQtypes map[uint16]bool
+
+	strategy string
+	next     uint32 // round-robin counter
+
+	queryLogs *DnsQueryLogs
+	filters   DnsFilterChain   // applied to answers from backend dns
+	dnssec    *DnssecValidator // nil if dnssec validation is off
 }
 
 type DnsClient struct {
-	client *dns.Client
-	ns     NameServer
+	client  *dns.Client
+	ns      NameServer
+	tracker *upstreamTracker
 }
 
 type DnsClients map[string]*DnsClient // map["tcp(8.8.8.8:53)"]*dns.Client
 
 func (c DnsClients) Exchange(r *dns.Msg, ns string) (*dns.Msg, time.Duration, error) {
 	n := c[ns]
-	return n.client.Exchange(r, n.ns.String())
+	msg, rtt, err := n.client.Exchange(r, n.ns.String())
+	if err == nil && msg.Rcode == dns.RcodeServerFailure {
+		n.tracker.observe(rtt, fmt.Errorf("code %d", msg.Rcode))
+	} else {
+		n.tracker.observe(rtt, err)
+	}
+	return msg, rtt, err
 }
 
 func (d *Dns) resolve(r *dns.Msg) (*dns.Msg, error) {
+	msg, _, err := d.exchange(r)
+	return msg, err
+}
+
+// resolve and log the backend dns used
+func (d *Dns) resolveLog(r *dns.Msg, ql *DnsQueryLog) (*dns.Msg, error) {
+	msg, ns, err := d.exchange(r)
+	ql.Upstream = ns
+	return msg, err
+}
+
+type dnsAnswer struct {
+	msg *dns.Msg
+	ns  string
+}
+
+// return filtered answer and the backend dns answered it
+func (d *Dns) exchange(r *dns.Msg) (*dns.Msg, string, error) {
+	return d.exchangeBy(r, d.exchangeUpstreams)
+}
+
+// validated and filtered answer of r, exchanged by backend dns or through proxy
+func (d *Dns) exchangeBy(r *dns.Msg, exchange func(*dns.Msg) (*dns.Msg, string, error)) (*dns.Msg, string, error) {
+	req := r
+	if d.dnssec != nil {
+		req = dnssecRequest(r)
+	}
+	msg, ns, err := exchange(req)
+	if err != nil {
+		return nil, ns, err
+	}
+	if d.dnssec != nil {
+		msg = d.dnssec.Answer(r, msg)
+	}
+	if msg = d.filters.Filter(r, msg); msg == nil {
+		return nil, ns, resolveErr
+	}
+	return msg, ns, nil
+}
+
+func (d *Dns) exchangeUpstreams(r *dns.Msg) (*dns.Msg, string, error) {
 	var wg sync.WaitGroup
-	msgCh := make(chan *dns.Msg, 1)
+	msgCh := make(chan dnsAnswer, 1)
 
 	qname := r.Question[0].Name
 
@@ -68,83 +158,204 @@ func (d *Dns) resolve(r *dns.Msg) (*dns.Msg, error) {
 		logger.Debugf("[dns] resolve %s on %s, code: %d, rtt: %d", qname, ns, r.Rcode, rtt)
 
 		select {
-		case msgCh <- r:
+		case msgCh <- dnsAnswer{r, ns}:
 		default:
 		}
 	}
 
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer ticker.Stop()
-
-	for _, ns := range d.nameservers {
+	stagger := d.stagger()
+	for _, ns := range d.upstreams() {
 		wg.Add(1)
 		go Q(ns)
 
+		if stagger == 0 {
+			continue
+		}
 		select {
-		case r := <-msgCh:
-			return r, nil
-		case <-ticker.C:
+		case a := <-msgCh:
+			return a.msg, a.ns, nil
+		case <-time.After(stagger):
 			continue
 		}
 	}
 
-	wg.Wait()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case a := <-msgCh:
+		return a.msg, a.ns, nil
+	case <-done:
+	}
 
 	select {
-	case r := <-msgCh:
-		return r, nil
+	case a := <-msgCh:
+		return a.msg, a.ns, nil
 	default:
 		logger.Debugf("[dns] query %s failed", qname)
-		return nil, resolveErr
+		return nil, "", resolveErr
+	}
+}
+
+// resolve through proxy by dns over tcp, so the query never leaks to local network
+func (d *Dns) resolveByProxy(proxy string, r *dns.Msg) (*dns.Msg, error) {
+	msg, _, err := d.exchangeBy(r, func(req *dns.Msg) (*dns.Msg, string, error) {
+		return d.exchangeByProxy(proxy, req)
+	})
+	return msg, err
+}
+
+func (d *Dns) exchangeByProxy(proxy string, r *dns.Msg) (*dns.Msg, string, error) {
+	qname := r.Question[0].Name
+	for _, ns := range d.proxyNameservers {
+		conn, err := d.one.proxies.Dial("tcp", proxy, ns)
+		if err != nil {
+			logger.Debugf("[dns] dial %s by proxy %q failed: %v", ns, proxy, err)
+			continue
+		}
+
+		co := &dns.Conn{Conn: conn}
+		co.SetDeadline(time.Now().Add(d.timeout))
+		err = co.WriteMsg(r)
+		var msg *dns.Msg
+		if err == nil {
+			msg, err = co.ReadMsg()
+		}
+		co.Close()
+
+		if err != nil {
+			logger.Debugf("[dns] resolve %s on %s by proxy %q failed: %v", qname, ns, proxy, err)
+			continue
+		}
+
+		if msg.Rcode == dns.RcodeServerFailure {
+			logger.Debugf("[dns] resolve %s on %s by proxy %q failed: code %d", qname, ns, proxy, msg.Rcode)
+			continue
+		}
+
+		logger.Debugf("[dns] resolve %s on %s by proxy %q, code: %d", qname, ns, proxy, msg.Rcode)
+		return msg, ns, nil
 	}
+	return nil, "", resolveErr
+}
+
+func (d *Dns) proxyResolveMode(proxy string) string {
+	if mode := d.one.proxies.Resolve(proxy); mode != "" {
+		return mode
+	}
+	return d.proxyResolve
 }
 
 func (d *Dns) fillRealIP(record *DomainRecord, r *dns.Msg) {
-	// resolve
-	msg, err := d.resolve(r)
+	var msg *dns.Msg
+	var err error
+
+	switch d.proxyResolveMode(record.Proxy) {
+	case proxyResolveNone:
+		return
+	case proxyResolveRemote:
+		msg, err = d.resolveByProxy(record.Proxy, r)
+	default:
+		msg, err = d.resolve(r)
+	}
+
 	if err != nil || len(msg.Answer) == 0 {
 		return
 	}
-	record.SetRealIP(msg)
+	d.one.dnsTable.SetRealIP(record, msg)
 }
 
-func (d *Dns) doIPv4Query(r *dns.Msg) (*dns.Msg, error) {
+// record hijacked for client src by source pattern, nil pattern if no source
+// pattern applies, nil record if the pattern doesn't use proxy
+func (d *Dns) sourceRecord(src net.IP, domain string) (record *DomainRecord, pattern Pattern) {
 	one := d.one
+	rule := one.rules.Load()
+
+	if pattern = rule.SourcePattern(src, domain); pattern == nil || pattern.Proxy() == "" {
+		return nil, pattern
+	}
+
+	if record = one.dnsTable.Get(domain); record != nil {
+		return record, pattern
+	}
+	// other clients still follow the proxy decided by domain
+	matched, proxy := rule.Proxy(domain)
+	if matched && proxy != "" {
+		record = one.dnsTable.Set(domain, proxy)
+	} else {
+		record = one.dnsTable.SetSource(domain, proxy)
+	}
+	if record != nil {
+		r := new(dns.Msg)
+		r.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+		go d.fillRealIP(record, r)
+	}
+	return record, pattern
+}
+
+func (d *Dns) doIPv4Query(r *dns.Msg, ql *DnsQueryLog) (*dns.Msg, error) {
+	one := d.one
+	rule := one.rules.Load()
 
 	domain := dnsutil.TrimDomainName(r.Question[0].Name, ".")
+	src := net.ParseIP(ql.Client)
 
 	// if is a reject domain
-	if one.rule.Reject(domain) {
+	if rule.RejectFrom(src, domain) {
+		ql.Decision = dnsDecisionReject
 		return nil, errors.New(domain + "is a reject domain")
 	}
 
+	// if must get real answer
+	if d.matchFakeIPFilter(domain) {
+		ql.Decision = dnsDecisionFakeIPFilter
+		return d.resolveLog(r, ql)
+	}
+
+	// if decided by client
+	if record, pattern := d.sourceRecord(src, domain); pattern != nil {
+		if record == nil {
+			ql.Decision = dnsDecisionNonProxy
+			return d.resolveLog(r, ql)
+		}
+		ql.Decision, ql.Proxy = dnsDecisionProxy, pattern.Proxy()
+		return record.Answer(r), nil
+	}
+
 	// if is a non-proxy-domain
 	if one.dnsTable.IsNonProxyDomain(domain) {
 		logger.Infof("IsNonProxyDomain: %v", domain)
-		return d.resolve(r)
+		ql.Decision = dnsDecisionNonProxy
+		return d.resolveLog(r, ql)
 	}
 
 	// if have already hijacked
 	record := one.dnsTable.Get(domain)
-	if record != nil {
+	if record != nil && !record.Source {
 		logger.Infof("have already hijacked: %v", domain)
+		ql.Decision, ql.Proxy = dnsDecisionCached, record.Proxy
 		return record.Answer(r), nil
 	}
 
 	// match by domain
-	matched, proxy := one.rule.Proxy(domain)
+	matched, proxy := rule.Proxy(domain)
 	logger.Infof("matched:%v, proxy:%s", matched, proxy)
 
 	// if domain use proxy
 	if matched && proxy != "" {
 		if record := one.dnsTable.Set(domain, proxy); record != nil {
 			go d.fillRealIP(record, r)
+			ql.Decision, ql.Proxy = dnsDecisionProxy, proxy
 			return record.Answer(r), nil
 		}
 	}
 
 	// resolve
-	msg, err := d.resolve(r)
+	ql.Decision = dnsDecisionNonProxy
+	msg, err := d.resolveLog(r, ql)
 	if err != nil || len(msg.Answer) == 0 {
 		return msg, err
 	}
@@ -156,11 +367,11 @@ func (d *Dns) doIPv4Query(r *dns.Msg) (*dns.Msg, error) {
 			switch answer := item.(type) {
 			case *dns.A:
 				// test ip
-				_, proxy = one.rule.Proxy(answer.A)
+				_, proxy = rule.Proxy(answer.A)
 				break OuterLoop
 			case *dns.CNAME:
 				// test cname
-				matched, proxy = one.rule.Proxy(answer.Target)
+				matched, proxy = rule.Proxy(answer.Target)
 				if matched && proxy != "" {
 					break OuterLoop
 				}
@@ -171,8 +382,9 @@ func (d *Dns) doIPv4Query(r *dns.Msg) (*dns.Msg, error) {
 		// if ip use proxy
 		if proxy != "" {
 			if record := one.dnsTable.Set(domain, proxy); record != nil {
-				record.SetRealIP(msg)
+				one.dnsTable.SetRealIP(record, msg)
 				logger.Infof("[dns] ---------- %s is a proxy-domain via %s by ip", domain, proxy)
+				ql.Decision, ql.Proxy = dnsDecisionProxy, proxy
 				return record.Answer(r), nil
 			}
 		} else {
@@ -194,33 +406,119 @@ func isIPv4Query(q dns.Question) bool {
 	return false
 }
 
-func (d *Dns) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
-	isIPv4 := isIPv4Query(r.Question[0])
-	logger.Infof("remote_addr:%s, r: %+v   isIPv4:%v", w.RemoteAddr(), r.Question, isIPv4)
+// answer by hosts, nil if not found
+func (d *Dns) doHostsQuery(r *dns.Msg, depth int, ql *DnsQueryLog) *dns.Msg {
+	q := r.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return nil
+	}
 
-	var msg *dns.Msg
-	var err error
+	entry := d.hosts.Lookup(dnsutil.TrimDomainName(q.Name, "."))
+	if entry == nil {
+		return nil
+	}
+	if entry.CNAME == "" && q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA && q.Qtype != dns.TypeANY {
+		return nil
+	}
 
-	if isIPv4 {
-		msg, err = d.doIPv4Query(r)
-	} else {
-		msg, err = d.resolve(r)
+	rsp, cname := d.hosts.Answer(r, entry)
+	if cname != "" && depth < hostsMaxCnameDepth {
+		// chase cname, target may be a proxy domain too
+		req := r.Copy()
+		req.Question[0].Name = dns.Fqdn(cname)
+		if msg, err := d.query(req, depth+1, ql); err == nil {
+			rsp.Answer = append(rsp.Answer, msg.Answer...)
+			rsp.Rcode = msg.Rcode
+		}
+	}
+	logger.Debugf("[dns] %s answered by hosts", q.Name)
+	if depth == 0 {
+		ql.Decision = dnsDecisionHosts
+	}
+	return rsp
+}
+
+func (d *Dns) query(r *dns.Msg, depth int, ql *DnsQueryLog) (*dns.Msg, error) {
+	if msg := d.doHostsQuery(r, depth, ql); msg != nil {
+		return msg, nil
 	}
 
+	if isIPv4Query(r.Question[0]) {
+		return d.doIPv4Query(r, ql)
+	}
+	return d.doOtherQuery(r, ql)
+}
+
+func (d *Dns) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	isIPv4 := isIPv4Query(r.Question[0])
+	logger.Infof("remote_addr:%s, r: %+v   isIPv4:%v", w.RemoteAddr(), r.Question, isIPv4)
+
+	ql := newDnsQueryLog(d.realClient(w.RemoteAddr()), r.Question[0])
+	msg, err := d.query(r, 0, ql)
 	if err != nil {
 		logger.Errorf("%e", err)
 		dns.HandleFailed(w, r)
+		ql.done(dns.RcodeServerFailure)
 	} else {
 		w.WriteMsg(msg)
+		ql.done(msg.Rcode)
+	}
+	d.queryLogs.Add(ql)
+}
+
+// client address of intercepted query
+func (d *Dns) realClient(addr net.Addr) net.Addr {
+	if !d.intercept {
+		return addr
+	}
+
+	var session *NatSession
+	switch v := addr.(type) {
+	case *net.UDPAddr:
+		session = d.one.udpRelay.dnsSession(v.IP, uint16(v.Port))
+	case *net.TCPAddr:
+		session = d.one.tcpRelay.dnsSession(v.IP, uint16(v.Port))
+	}
+	if session == nil {
+		return addr
+	}
+	return &net.UDPAddr{IP: session.srcIP, Port: int(session.srcPort)}
+}
+
+// domain must get real answer
+func (d *Dns) matchFakeIPFilter(domain string) bool {
+	f, _ := d.fakeIPFilter.Load().(*FakeIPFilter)
+	return f != nil && f.Match(domain)
+}
+
+// fake ip filter of new config, patterns of the last one stop receiving provider updates
+func (d *Dns) reloadFakeIPFilter(cfg DnsConfig, patterns map[string]*PatternConfig, providers *Providers) {
+	last, _ := d.fakeIPFilter.Load().(*FakeIPFilter)
+	d.fakeIPFilter.Store(NewFakeIPFilter(cfg, patterns, providers))
+	if last != nil {
+		last.close()
 	}
 }
 
 func (d *Dns) Serve() error {
+	if d.tcpServer != nil {
+		errCh := make(chan error, 1)
+		go func() {
+			logger.Infof("[dns] listen on tcp %s", d.tcpServer.Addr)
+			errCh <- d.tcpServer.ListenAndServe()
+		}()
+		go func() {
+			logger.Infof("[dns] listen on %s", d.server.Addr)
+			errCh <- d.server.ListenAndServe()
+		}()
+		return <-errCh
+	}
+
 	logger.Infof("[dns] listen on %s", d.server.Addr)
 	return d.server.ListenAndServe()
 }
 
-func NewDns(one *One, cfg DnsConfig) (*Dns, error) {
+func NewDns(one *One, cfg DnsConfig, hosts *Hosts, patterns map[string]*PatternConfig) (*Dns, error) {
 	d := new(Dns)
 	d.one = one
 
@@ -234,13 +532,53 @@ func NewDns(one *One, cfg DnsConfig) (*Dns, error) {
 	}
 
 	d.server = server
+	d.port = cfg.DnsPort
+	d.intercept = cfg.Intercept
+	if d.intercept {
+		d.tcpServer = &dns.Server{
+			Net:          "tcp",
+			Addr:         server.Addr,
+			Handler:      server.Handler,
+			ReadTimeout:  server.ReadTimeout,
+			WriteTimeout: server.WriteTimeout,
+		}
+	}
 	d.nameservers = cfg.Nameserver
 	d.clients = GetDnsClients(cfg)
+	d.strategy = cfg.UpstreamStrategy
+	d.queryLogs = NewDnsQueryLogs(cfg)
+	d.filters = NewDnsFilterChain(cfg)
+	d.proxyResolve = cfg.ProxyResolve
+	d.proxyNameservers = cfg.ProxyNameserver
+	d.timeout = time.Duration(cfg.DnsReadTimeout+cfg.DnsWriteTimeout) * time.Second
+	d.reloadFakeIPFilter(cfg, patterns, one.providers)
+	d.hosts = hosts
+	d.aaaaPolicy = cfg.AAAAPolicy
+	d.httpsPolicy = cfg.HTTPSPolicy
+	d.blockQtypes = make(map[uint16]bool)
+	for _, name := range cfg.BlockQtype {
+		qtype, err := parseQtype(name)
+		if err != nil {
+			return nil, err
+		}
+		d.blockQtypes[qtype] = true
+	}
+
+	if cfg.Dnssec {
+		exchange := func(r *dns.Msg) (*dns.Msg, error) {
+			msg, _, err := d.exchangeUpstreams(r)
+			return msg, err
+		}
+		var err error
+		if d.dnssec, err = NewDnssecValidator(cfg.TrustAnchor, exchange); err != nil {
+			return nil, err
+		}
+	}
 
 	return d, nil
 }
 
-func GetDnsClients(cfg DnsConfig) ( DnsClients) {
+func GetDnsClients(cfg DnsConfig) DnsClients {
 	clients := make(DnsClients)
 	for _, ns := range cfg.Nameserver {
 		nameserver := parseNs(ns)
@@ -252,6 +590,10 @@ func GetDnsClients(cfg DnsConfig) ( DnsClients) {
 				WriteTimeout: time.Duration(cfg.DnsWriteTimeout) * time.Second,
 			},
 			ns: nameserver,
+			tracker: &upstreamTracker{
+				stats:   UpstreamStats{Nameserver: ns},
+				penalty: time.Duration(cfg.DnsReadTimeout+cfg.DnsWriteTimeout) * time.Second,
+			},
 		}
 	}
 	return clients
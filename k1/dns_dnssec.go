@@ -0,0 +1,529 @@
+package k1
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// result of dnssec validation
+const (
+	dnssecSecure   = iota // chain of trust from a trust anchor
+	dnssecInsecure        // proven unsigned, or not under any trust anchor
+	dnssecBogus           // signature missing or invalid where required
+)
+
+// root zone ksk, https://data.iana.org/root-anchors/root-anchors.xml
+var dnssecRootAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBB683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+const dnssecMaxKeyTtl = 3600 // max seconds to cache validated keys
+
+var errDnssecBogus = errors.New("dnssec bogus")
+
+// validated keys of a zone
+type dnssecZone struct {
+	keys    []*dns.DNSKEY // nil if zone is insecure
+	expires time.Time
+}
+
+// validate answers from backend dns, fetch DNSKEY and DS by exchange
+type DnssecValidator struct {
+	anchors  map[string][]dns.RR // zone -> DS or DNSKEY
+	exchange func(r *dns.Msg) (*dns.Msg, error)
+
+	lock  sync.Mutex // protect zones
+	zones map[string]*dnssecZone
+}
+
+type rrsetKey struct {
+	name   string
+	rrtype uint16
+}
+
+// group records into rrsets and their signatures
+func splitRRsets(rrs []dns.RR) (map[rrsetKey][]dns.RR, map[rrsetKey][]*dns.RRSIG) {
+	rrsets := make(map[rrsetKey][]dns.RR)
+	sigs := make(map[rrsetKey][]*dns.RRSIG)
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+		switch v := rr.(type) {
+		case *dns.RRSIG:
+			key := rrsetKey{name, v.TypeCovered}
+			sigs[key] = append(sigs[key], v)
+		case *dns.OPT:
+		default:
+			key := rrsetKey{name, hdr.Rrtype}
+			rrsets[key] = append(rrsets[key], rr)
+		}
+	}
+	return rrsets, sigs
+}
+
+func isZoneKey(key *dns.DNSKEY) bool {
+	return key.Flags&dns.ZONE != 0 && key.Flags&dns.REVOKE == 0 && key.Protocol == 3
+}
+
+// rrset is signed by any of keys
+func verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY, now time.Time) bool {
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, key := range keys {
+			if sig.KeyTag != key.KeyTag() || sig.Algorithm != key.Algorithm || !isZoneKey(key) {
+				continue
+			}
+			if sig.Verify(key, rrset) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// signer of rrset, must be the owner or an ancestor of it
+func signerOf(name string, sigs []*dns.RRSIG) (string, bool) {
+	if len(sigs) == 0 {
+		return "", false
+	}
+	signer := strings.ToLower(dns.Fqdn(sigs[0].SignerName))
+	for _, sig := range sigs[1:] {
+		if !strings.EqualFold(sig.SignerName, signer) {
+			return "", false
+		}
+	}
+	return signer, dns.IsSubDomain(signer, name)
+}
+
+func parentName(name string) (string, bool) {
+	if name == "." {
+		return "", false
+	}
+	if i, end := dns.NextLabel(name, 0); !end {
+		return name[i:], true
+	}
+	return ".", true
+}
+
+// compare domain names in canonical order, rfc 4034 6.1
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// name is between owner and next of NSEC
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// last NSEC of zone
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+func hasType(bitmap []uint16, rrtype uint16) bool {
+	for _, t := range bitmap {
+		if t == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+// denial of existence in authority section, return types of the name if it exists
+func denial(ns []dns.RR, name string) (types []uint16, exists bool, proven bool) {
+	for _, rr := range ns {
+		switch v := rr.(type) {
+		case *dns.NSEC:
+			if strings.EqualFold(v.Hdr.Name, name) {
+				return v.TypeBitMap, true, true
+			}
+			if nsecCovers(v, name) {
+				proven = true
+			}
+		case *dns.NSEC3:
+			if v.Match(name) {
+				return v.TypeBitMap, true, true
+			}
+			if v.Cover(name) {
+				proven = true
+			}
+		}
+	}
+	return nil, false, proven
+}
+
+// nsec3 opt-out covering name, the delegation may be unsigned
+func optOut(ns []dns.RR, name string) bool {
+	for _, rr := range ns {
+		if v, ok := rr.(*dns.NSEC3); ok && v.Flags&1 == 1 && v.Cover(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *DnssecValidator) query(name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(dnsDefaultPacketSize, true)
+	return v.exchange(m)
+}
+
+func (v *DnssecValidator) cached(zone string) *dnssecZone {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if z := v.zones[zone]; z != nil && z.expires.After(time.Now()) {
+		return z
+	}
+	return nil
+}
+
+func (v *DnssecValidator) cache(zone string, keys []*dns.DNSKEY, ttl uint32) *dnssecZone {
+	if ttl > dnssecMaxKeyTtl {
+		ttl = dnssecMaxKeyTtl
+	}
+	z := &dnssecZone{keys: keys, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+	v.lock.Lock()
+	v.zones[zone] = z
+	v.lock.Unlock()
+	return z
+}
+
+// anchor zone of name, empty if not under any trust anchor
+func (v *DnssecValidator) anchorOf(name string) string {
+	for zone := name; ; {
+		if _, ok := v.anchors[zone]; ok {
+			return zone
+		}
+		parent, ok := parentName(zone)
+		if !ok {
+			return ""
+		}
+		zone = parent
+	}
+}
+
+// DNSKEY of zone matching any of trusted DS or DNSKEY
+func (v *DnssecValidator) fetchKeys(zone string, trusted []dns.RR, now time.Time) ([]*dns.DNSKEY, uint32, error) {
+	msg, err := v.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rrsets, sigs := splitRRsets(msg.Answer)
+	key := rrsetKey{zone, dns.TypeDNSKEY}
+	rrset := rrsets[key]
+
+	var keys, entries []*dns.DNSKEY
+	ttl := uint32(dnssecMaxKeyTtl)
+	for _, rr := range rrset {
+		k := rr.(*dns.DNSKEY)
+		keys = append(keys, k)
+		if k.Hdr.Ttl < ttl {
+			ttl = k.Hdr.Ttl
+		}
+		for _, t := range trusted {
+			switch anchor := t.(type) {
+			case *dns.DS:
+				ds := k.ToDS(anchor.DigestType)
+				if ds != nil && ds.KeyTag == anchor.KeyTag && strings.EqualFold(ds.Digest, anchor.Digest) {
+					entries = append(entries, k)
+				}
+			case *dns.DNSKEY:
+				if k.Algorithm == anchor.Algorithm && k.PublicKey == anchor.PublicKey {
+					entries = append(entries, k)
+				}
+			}
+		}
+	}
+
+	// DNSKEY rrset is self signed by a trusted entry key
+	if len(entries) == 0 || !verifyRRset(rrset, sigs[key], entries, now) {
+		return nil, 0, fmt.Errorf("%w: DNSKEY of %s", errDnssecBogus, zone)
+	}
+	return keys, ttl, nil
+}
+
+// validated keys of the zone containing name, nil keys if it's insecure
+func (v *DnssecValidator) zoneKeys(name string) (*dnssecZone, error) {
+	name = strings.ToLower(dns.Fqdn(name))
+	if z := v.cached(name); z != nil {
+		return z, nil
+	}
+
+	now := time.Now()
+	if anchors, ok := v.anchors[name]; ok {
+		keys, ttl, err := v.fetchKeys(name, anchors, now)
+		if err != nil {
+			return nil, err
+		}
+		return v.cache(name, keys, ttl), nil
+	}
+
+	// not under any trust anchor
+	if v.anchorOf(name) == "" {
+		return v.cache(name, nil, dnssecMaxKeyTtl), nil
+	}
+
+	// look for a secure delegation
+	msg, err := v.query(name, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+	answers, answerSigs := splitRRsets(msg.Answer)
+	authority, authoritySigs := splitRRsets(msg.Ns)
+
+	if ds := answers[rrsetKey{name, dns.TypeDS}]; len(ds) > 0 {
+		sigs := answerSigs[rrsetKey{name, dns.TypeDS}]
+		signer, ok := signerOf(name, sigs)
+		if !ok || signer == name {
+			return nil, fmt.Errorf("%w: DS of %s is not signed by parent", errDnssecBogus, name)
+		}
+		parent, err := v.zoneKeys(signer)
+		if err != nil {
+			return nil, err
+		}
+		if parent.keys == nil {
+			return v.cache(name, nil, ds[0].Header().Ttl), nil
+		}
+		if !verifyRRset(ds, sigs, parent.keys, now) {
+			return nil, fmt.Errorf("%w: DS of %s", errDnssecBogus, name)
+		}
+		keys, ttl, err := v.fetchKeys(name, ds, now)
+		if err != nil {
+			return nil, err
+		}
+		return v.cache(name, keys, ttl), nil
+	}
+
+	// no DS, the name is an insecure delegation or inside the parent zone
+	var signer string
+	for key, sigs := range authoritySigs {
+		if s, ok := signerOf(key.name, sigs); ok {
+			signer = s
+			break
+		}
+	}
+	if signer == "" || signer == name {
+		// unsigned denial, secure only if the parent zone is
+		parent, _ := parentName(name)
+		z, err := v.zoneKeys(parent)
+		if err != nil {
+			return nil, err
+		}
+		if z.keys != nil {
+			return nil, fmt.Errorf("%w: unsigned denial of DS %s", errDnssecBogus, name)
+		}
+		return v.cache(name, nil, dnssecMaxKeyTtl), nil
+	}
+
+	parent, err := v.zoneKeys(signer)
+	if err != nil {
+		return nil, err
+	}
+	if parent.keys == nil {
+		return v.cache(name, nil, dnssecMaxKeyTtl), nil
+	}
+	for key, rrset := range authority {
+		if !verifyRRset(rrset, authoritySigs[key], parent.keys, now) {
+			return nil, fmt.Errorf("%w: denial of DS %s", errDnssecBogus, name)
+		}
+	}
+
+	types, exists, proven := denial(msg.Ns, name)
+	switch {
+	case exists && hasType(types, dns.TypeDS):
+		return nil, fmt.Errorf("%w: DS of %s is stripped", errDnssecBogus, name)
+	case exists && hasType(types, dns.TypeNS) && !hasType(types, dns.TypeSOA):
+		// insecure delegation
+		return v.cache(name, nil, dnssecMaxKeyTtl), nil
+	case exists || proven:
+		// not a zone cut, or doesn't exist at all
+		return v.cache(name, parent.keys, uint32(time.Until(parent.expires).Seconds())), nil
+	case optOut(msg.Ns, name):
+		return v.cache(name, nil, dnssecMaxKeyTtl), nil
+	}
+	return nil, fmt.Errorf("%w: no denial of DS %s", errDnssecBogus, name)
+}
+
+// validate a section, unsigned rrsets are insecure only in insecure zones
+func (v *DnssecValidator) validateRRs(rrs []dns.RR, now time.Time) (int, error) {
+	result := dnssecSecure
+	rrsets, sigs := splitRRsets(rrs)
+	for key, rrset := range rrsets {
+		signer, ok := signerOf(key.name, sigs[key])
+		if len(sigs[key]) > 0 && !ok {
+			return dnssecBogus, fmt.Errorf("%w: invalid signer of %s", errDnssecBogus, key.name)
+		}
+		if !ok {
+			signer = key.name
+		}
+
+		z, err := v.zoneKeys(signer)
+		if err != nil {
+			return dnssecBogus, err
+		}
+		if z.keys == nil {
+			result = dnssecInsecure
+			continue
+		}
+		if !verifyRRset(rrset, sigs[key], z.keys, now) {
+			return dnssecBogus, fmt.Errorf("%w: %s %s", errDnssecBogus, key.name, dns.Type(key.rrtype))
+		}
+	}
+	return result, nil
+}
+
+func (v *DnssecValidator) Validate(msg *dns.Msg) (int, error) {
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return dnssecInsecure, nil
+	}
+
+	now := time.Now()
+	q := msg.Question[0]
+	qname := strings.ToLower(dns.Fqdn(q.Name))
+
+	if len(msg.Answer) > 0 {
+		return v.validateRRs(msg.Answer, now)
+	}
+
+	// negative answer
+	_, sigs := splitRRsets(msg.Ns)
+	if len(sigs) == 0 {
+		z, err := v.zoneKeys(qname)
+		if err != nil {
+			return dnssecBogus, err
+		}
+		if z.keys != nil {
+			return dnssecBogus, fmt.Errorf("%w: unsigned denial of %s", errDnssecBogus, qname)
+		}
+		return dnssecInsecure, nil
+	}
+
+	result, err := v.validateRRs(msg.Ns, now)
+	if result != dnssecSecure {
+		return result, err
+	}
+
+	types, exists, proven := denial(msg.Ns, qname)
+	if msg.Rcode == dns.RcodeNameError {
+		if !proven || exists {
+			return dnssecBogus, fmt.Errorf("%w: no proof of nxdomain %s", errDnssecBogus, qname)
+		}
+	} else if exists {
+		if hasType(types, q.Qtype) || hasType(types, dns.TypeCNAME) {
+			return dnssecBogus, fmt.Errorf("%w: no proof of nodata %s", errDnssecBogus, qname)
+		}
+	} else if !optOut(msg.Ns, qname) {
+		return dnssecBogus, fmt.Errorf("%w: no proof of nodata %s", errDnssecBogus, qname)
+	}
+	return dnssecSecure, nil
+}
+
+// request dnssec records from backend dns
+func dnssecRequest(r *dns.Msg) *dns.Msg {
+	req := r.Copy()
+	if opt := req.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		req.SetEdns0(dnsDefaultPacketSize, true)
+	}
+	return req
+}
+
+func stripDnssecRRs(rrs []dns.RR, qtype uint16) []dns.RR {
+	return filterRRs(rrs, func(rr dns.RR) bool {
+		switch t := rr.Header().Rrtype; t {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			return t != qtype
+		}
+		return false
+	})
+}
+
+// validate answer of request r, answer SERVFAIL if it's bogus
+func (v *DnssecValidator) Answer(r *dns.Msg, msg *dns.Msg) *dns.Msg {
+	if !r.CheckingDisabled {
+		result, err := v.Validate(msg)
+		if result == dnssecBogus {
+			logger.Infof("[dns] dnssec validate %s failed: %v", r.Question[0].Name, err)
+			rsp := emptyAnswer(r)
+			rsp.Rcode = dns.RcodeServerFailure
+			return rsp
+		}
+		msg.AuthenticatedData = result == dnssecSecure
+	}
+
+	// client doesn't ask for dnssec records
+	opt := r.IsEdns0()
+	if opt == nil || !opt.Do() {
+		qtype := r.Question[0].Qtype
+		msg.Answer = stripDnssecRRs(msg.Answer, qtype)
+		msg.Ns = stripDnssecRRs(msg.Ns, qtype)
+		msg.Extra = filterRRs(msg.Extra, func(rr dns.RR) bool {
+			if o, ok := rr.(*dns.OPT); ok {
+				if opt == nil {
+					return true
+				}
+				o.SetDo(false)
+			}
+			return rr.Header().Rrtype == dns.TypeRRSIG
+		})
+	}
+	return msg
+}
+
+func parseTrustAnchors(vals []string) (map[string][]dns.RR, error) {
+	anchors := make(map[string][]dns.RR)
+	for _, val := range vals {
+		rr, err := dns.NewRR(val)
+		if err != nil || rr == nil {
+			return nil, fmt.Errorf("invalid trust-anchor: %s", val)
+		}
+		switch rr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+		default:
+			return nil, fmt.Errorf("trust-anchor is neither DS nor DNSKEY: %s", val)
+		}
+		zone := strings.ToLower(dns.Fqdn(rr.Header().Name))
+		anchors[zone] = append(anchors[zone], rr)
+	}
+	return anchors, nil
+}
+
+func checkDnssec(cfg DnsConfig) error {
+	if _, err := parseTrustAnchors(cfg.TrustAnchor); err != nil {
+		return fmt.Errorf("[check dns] %v", err)
+	}
+	return nil
+}
+
+func NewDnssecValidator(trustAnchors []string, exchange func(r *dns.Msg) (*dns.Msg, error)) (*DnssecValidator, error) {
+	if len(trustAnchors) == 0 {
+		trustAnchors = dnssecRootAnchors
+	}
+	anchors, err := parseTrustAnchors(trustAnchors)
+	if err != nil {
+		return nil, err
+	}
+	return &DnssecValidator{
+		anchors:  anchors,
+		exchange: exchange,
+		zones:    make(map[string]*dnssecZone),
+	}, nil
+}
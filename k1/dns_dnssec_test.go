@@ -0,0 +1,206 @@
+package k1
+
+import (
+	"crypto"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type testZoneKey struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZoneKey(t *testing.T, zone string) *testZoneKey {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testZoneKey{key, priv.(crypto.Signer)}
+}
+
+func (k *testZoneKey) sign(t *testing.T, rrs ...dns.RR) []dns.RR {
+	sig := &dns.RRSIG{
+		KeyTag:     k.key.KeyTag(),
+		SignerName: k.key.Hdr.Name,
+		Algorithm:  k.key.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	sig.Hdr.Ttl = rrs[0].Header().Ttl
+	if err := sig.Sign(k.priv, rrs); err != nil {
+		t.Fatal(err)
+	}
+	return append(rrs, sig)
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+type testZoneAnswer struct {
+	rcode  int
+	answer []dns.RR
+	ns     []dns.RR
+}
+
+// authoritative stand-in of signed zones on localhost
+func serveTestZones(t *testing.T, answers map[rrsetKey]testZoneAnswer) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        pc,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			q := r.Question[0]
+			rsp := new(dns.Msg)
+			rsp.SetReply(r)
+			rsp.Authoritative = true
+			if a, ok := answers[rrsetKey{strings.ToLower(q.Name), q.Qtype}]; ok {
+				rsp.Rcode = a.rcode
+				rsp.Answer = a.answer
+				rsp.Ns = a.ns
+			} else {
+				rsp.Rcode = dns.RcodeNameError
+			}
+			w.WriteMsg(rsp)
+		}),
+	}
+	go server.ActivateAndServe()
+	<-started
+	return pc.LocalAddr().String(), func() { server.Shutdown() }
+}
+
+func TestDnssecValidator(t *testing.T) {
+	ex := newTestZoneKey(t, "example.")
+	sub := newTestZoneKey(t, "sub.example.")
+
+	bad := ex.sign(t, mustRR(t, "bad.example. 300 IN A 192.0.2.99"))
+	bad[0].(*dns.A).A = net.ParseIP("192.0.2.2")
+
+	answers := map[rrsetKey]testZoneAnswer{
+		{"example.", dns.TypeDNSKEY}: {answer: ex.sign(t, ex.key)},
+		{"www.example.", dns.TypeA}:  {answer: ex.sign(t, mustRR(t, "www.example. 300 IN A 192.0.2.1"))},
+		{"bad.example.", dns.TypeA}:  {answer: bad},
+
+		// signature stripped
+		{"stripped.example.", dns.TypeA}: {answer: []dns.RR{mustRR(t, "stripped.example. 300 IN A 192.0.2.3")}},
+		{"stripped.example.", dns.TypeDS}: {ns: ex.sign(t,
+			mustRR(t, "stripped.example. 300 IN NSEC sub.example. A RRSIG NSEC"))},
+
+		{"nx.example.", dns.TypeA}: {rcode: dns.RcodeNameError, ns: ex.sign(t,
+			mustRR(t, "insecure.example. 300 IN NSEC stripped.example. NS RRSIG NSEC"))},
+
+		// secure delegation
+		{"sub.example.", dns.TypeDS}:     {answer: ex.sign(t, sub.key.ToDS(dns.SHA256))},
+		{"sub.example.", dns.TypeDNSKEY}: {answer: sub.sign(t, sub.key)},
+		{"host.sub.example.", dns.TypeA}: {answer: sub.sign(t, mustRR(t, "host.sub.example. 300 IN A 192.0.2.4"))},
+
+		// insecure delegation
+		{"insecure.example.", dns.TypeDS}: {ns: ex.sign(t,
+			mustRR(t, "insecure.example. 300 IN NSEC stripped.example. NS RRSIG NSEC"))},
+		{"host.insecure.example.", dns.TypeDS}: {ns: []dns.RR{
+			mustRR(t, "insecure.example. 300 IN SOA ns.insecure.example. admin.insecure.example. 1 3600 600 86400 300")}},
+		{"host.insecure.example.", dns.TypeA}: {answer: []dns.RR{mustRR(t, "host.insecure.example. 300 IN A 192.0.2.5")}},
+
+		// not under trust anchor
+		{"other.test.", dns.TypeA}: {answer: []dns.RR{mustRR(t, "other.test. 300 IN A 192.0.2.6")}},
+	}
+	addr, shutdown := serveTestZones(t, answers)
+	defer shutdown()
+
+	client := new(dns.Client)
+	exchange := func(r *dns.Msg) (*dns.Msg, error) {
+		msg, _, err := client.Exchange(r, addr)
+		return msg, err
+	}
+	v, err := NewDnssecValidator([]string{ex.key.ToDS(dns.SHA256).String()}, exchange)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name   string
+		rcode  int
+		secure bool
+	}{
+		{"www.example.", dns.RcodeSuccess, true},
+		{"bad.example.", dns.RcodeServerFailure, false},
+		{"stripped.example.", dns.RcodeServerFailure, false},
+		{"nx.example.", dns.RcodeNameError, true},
+		{"host.sub.example.", dns.RcodeSuccess, true},
+		{"host.insecure.example.", dns.RcodeSuccess, false},
+		{"other.test.", dns.RcodeSuccess, false},
+	} {
+		r := new(dns.Msg)
+		r.SetQuestion(c.name, dns.TypeA)
+		msg, err := exchange(dnssecRequest(r))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg = v.Answer(r, msg)
+		if msg.Rcode != c.rcode || msg.AuthenticatedData != c.secure {
+			t.Errorf("%s: rcode %s, ad %v", c.name, dns.RcodeToString[msg.Rcode], msg.AuthenticatedData)
+		}
+		for _, rr := range append(msg.Answer, msg.Ns...) {
+			if rr.Header().Rrtype == dns.TypeRRSIG || rr.Header().Rrtype == dns.TypeNSEC {
+				t.Errorf("%s: dnssec records not asked: %v", c.name, rr)
+			}
+		}
+		if msg.IsEdns0() != nil {
+			t.Errorf("%s: edns not asked", c.name)
+		}
+	}
+
+	// client asks for dnssec records
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.", dns.TypeA)
+	r.SetEdns0(dnsDefaultPacketSize, true)
+	msg, err := exchange(dnssecRequest(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg = v.Answer(r, msg); !msg.AuthenticatedData || len(msg.Answer) != 2 {
+		t.Errorf("dnssec records: %v", msg)
+	}
+	// answers through proxy are validated the same
+	d := &Dns{dnssec: v}
+	byProxy := func(r *dns.Msg) (*dns.Msg, string, error) {
+		msg, err := exchange(r)
+		return msg, "proxy", err
+	}
+	for name, rcode := range map[string]int{"www.example.": dns.RcodeSuccess, "bad.example.": dns.RcodeServerFailure} {
+		r := new(dns.Msg)
+		r.SetQuestion(name, dns.TypeA)
+		if msg, _, err := d.exchangeBy(r, byProxy); err != nil || msg.Rcode != rcode {
+			t.Errorf("%s by proxy: %v %v", name, msg, err)
+		}
+	}
+}
+
+func TestCanonicalCompare(t *testing.T) {
+	names := []string{"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.", "zABC.a.EXAMPLE.", "z.example.", "*.z.example."}
+	for i := 1; i < len(names); i++ {
+		if canonicalCompare(names[i-1], names[i]) >= 0 {
+			t.Errorf("%s should be before %s", names[i-1], names[i])
+		}
+	}
+}
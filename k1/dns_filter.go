@@ -0,0 +1,197 @@
+package k1
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/miekg/dns/dnsutil"
+)
+
+// rewrite answer from backend dns, return nil to drop it
+type DnsFilter interface {
+	Filter(r *dns.Msg, msg *dns.Msg) *dns.Msg
+}
+
+type DnsFilterFunc func(r *dns.Msg, msg *dns.Msg) *dns.Msg
+
+func (f DnsFilterFunc) Filter(r *dns.Msg, msg *dns.Msg) *dns.Msg {
+	return f(r, msg)
+}
+
+// filters applied in order
+type DnsFilterChain []DnsFilter
+
+func (chain DnsFilterChain) Filter(r *dns.Msg, msg *dns.Msg) *dns.Msg {
+	for _, f := range chain {
+		if msg = f.Filter(r, msg); msg == nil {
+			return nil
+		}
+	}
+	return msg
+}
+
+func filterRRs(rrs []dns.RR, drop func(dns.RR) bool) []dns.RR {
+	var out []dns.RR
+	for _, rr := range rrs {
+		if !drop(rr) {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+func answerIP(rr dns.RR) net.IP {
+	switch v := rr.(type) {
+	case *dns.A:
+		return v.A
+	case *dns.AAAA:
+		return v.AAAA
+	}
+	return nil
+}
+
+// answer NXDOMAIN if any address is bogus, eg: ad servers of isp
+func bogusNXDomainFilter(ips []net.IP) DnsFilter {
+	bogus := make(map[string]bool)
+	for _, ip := range ips {
+		bogus[ip.String()] = true
+	}
+	return DnsFilterFunc(func(r *dns.Msg, msg *dns.Msg) *dns.Msg {
+		for _, rr := range msg.Answer {
+			if ip := answerIP(rr); ip != nil && bogus[ip.String()] {
+				logger.Infof("[dns] bogus answer %s -> %s", r.Question[0].Name, ip)
+				rsp := emptyAnswer(r)
+				rsp.Rcode = dns.RcodeNameError
+				return rsp
+			}
+		}
+		return msg
+	})
+}
+
+var privateNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+func isPrivateIP(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// drop private addresses in answer of public domains, prevent dns rebinding
+func rebindFilter(okDomains []string) DnsFilter {
+	ok := NewDomainSuffixPattern("rebind-domain-ok", DIRECT_POLICY, "", okDomains)
+	return DnsFilterFunc(func(r *dns.Msg, msg *dns.Msg) *dns.Msg {
+		domain := dnsutil.TrimDomainName(r.Question[0].Name, ".")
+		if ok.Match(domain) {
+			return msg
+		}
+		msg.Answer = filterRRs(msg.Answer, func(rr dns.RR) bool {
+			if ip := answerIP(rr); ip != nil && isPrivateIP(ip) {
+				logger.Infof("[dns] drop rebinding answer %s -> %s", domain, ip)
+				return true
+			}
+			return false
+		})
+		return msg
+	})
+}
+
+// raise ttl of records to minimum
+func minTtlFilter(ttl uint32) DnsFilter {
+	raise := func(rrs []dns.RR) {
+		for _, rr := range rrs {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT && hdr.Ttl < ttl {
+				hdr.Ttl = ttl
+			}
+		}
+	}
+	return DnsFilterFunc(func(r *dns.Msg, msg *dns.Msg) *dns.Msg {
+		raise(msg.Answer)
+		raise(msg.Ns)
+		raise(msg.Extra)
+		return msg
+	})
+}
+
+// remove records of types
+func stripTypeFilter(qtypes map[uint16]bool) DnsFilter {
+	drop := func(rr dns.RR) bool {
+		return qtypes[rr.Header().Rrtype]
+	}
+	return DnsFilterFunc(func(r *dns.Msg, msg *dns.Msg) *dns.Msg {
+		msg.Answer = filterRRs(msg.Answer, drop)
+		msg.Ns = filterRRs(msg.Ns, drop)
+		msg.Extra = filterRRs(msg.Extra, drop)
+		return msg
+	})
+}
+
+func checkDnsFilters(cfg DnsConfig) error {
+	for _, val := range cfg.BogusNXDomain {
+		if net.ParseIP(val) == nil {
+			return fmt.Errorf("[check dns] invalid bogus-nxdomain: %s", val)
+		}
+	}
+	for _, val := range cfg.StripType {
+		if _, err := parseQtype(val); err != nil {
+			return fmt.Errorf("[check dns] invalid strip-type: %s", val)
+		}
+	}
+	return nil
+}
+
+func NewDnsFilterChain(cfg DnsConfig) DnsFilterChain {
+	var chain DnsFilterChain
+
+	if len(cfg.StripType) > 0 {
+		qtypes := make(map[uint16]bool)
+		for _, val := range cfg.StripType {
+			if qtype, err := parseQtype(val); err == nil {
+				qtypes[qtype] = true
+			}
+		}
+		chain = append(chain, stripTypeFilter(qtypes))
+	}
+
+	if len(cfg.BogusNXDomain) > 0 {
+		var ips []net.IP
+		for _, val := range cfg.BogusNXDomain {
+			if ip := net.ParseIP(strings.TrimSpace(val)); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		chain = append(chain, bogusNXDomainFilter(ips))
+	}
+
+	if cfg.RebindProtection {
+		chain = append(chain, rebindFilter(cfg.RebindDomainOk))
+	}
+
+	if cfg.MinTtl > 0 {
+		chain = append(chain, minTtlFilter(uint32(cfg.MinTtl)))
+	}
+	return chain
+}
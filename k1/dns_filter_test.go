@@ -0,0 +1,51 @@
+package k1
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func newTestAnswer(t *testing.T, name string, rrs ...string) (*dns.Msg, *dns.Msg) {
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Answer = append(msg.Answer, rr)
+	}
+	return r, msg
+}
+
+func TestDnsFilterChain(t *testing.T) {
+	chain := NewDnsFilterChain(DnsConfig{
+		StripType:        []string{"AAAA"},
+		BogusNXDomain:    []string{"123.125.81.12"},
+		RebindProtection: true,
+		RebindDomainOk:   []string{"lan"},
+		MinTtl:           60,
+	})
+
+	r, msg := newTestAnswer(t, "example.com",
+		"example.com. 10 IN A 93.184.216.34",
+		"example.com. 10 IN A 192.168.1.1",
+		"example.com. 10 IN AAAA 2606:2800:220:1::1")
+	msg = chain.Filter(r, msg)
+	if len(msg.Answer) != 1 || msg.Answer[0].Header().Ttl != 60 {
+		t.Errorf("public domain: %v", msg.Answer)
+	}
+
+	r, msg = newTestAnswer(t, "nas.lan", "nas.lan. 10 IN A 192.168.1.1")
+	if msg = chain.Filter(r, msg); len(msg.Answer) != 1 {
+		t.Errorf("rebind domain ok: %v", msg.Answer)
+	}
+
+	r, msg = newTestAnswer(t, "nonexist.com", "nonexist.com. 10 IN A 123.125.81.12")
+	if msg = chain.Filter(r, msg); msg.Rcode != dns.RcodeNameError || len(msg.Answer) != 0 {
+		t.Errorf("bogus nxdomain: %v", msg)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"hash/adler32"
 	"net"
 
+	jsoniter "github.com/json-iterator/go"
+
 	"github.com/nxsre/kone/tcpip"
 )
 
@@ -12,13 +14,21 @@ const DnsIPPoolMaxSpace = 0x3ffff // 4*65535
 type DnsIPPool struct {
 	base  uint32
 	space uint32
-	flags []bool
+
+	// free indexes, allocated by swapping with the last one
+	free []uint32
+	// position of index in free, -1 if used
+	pos []int32
 }
 
 func (pool *DnsIPPool) Capacity() int {
 	return int(pool.space)
 }
 
+func (pool *DnsIPPool) Used() int {
+	return int(pool.space) - len(pool.free)
+}
+
 func (pool *DnsIPPool) Contains(ip net.IP) bool {
 	index := tcpip.ConvertIPv4ToUint32(ip) - pool.base
 	if index < pool.space {
@@ -27,55 +37,84 @@ func (pool *DnsIPPool) Contains(ip net.IP) bool {
 	return false
 }
 
+func (pool *DnsIPPool) take(index uint32) {
+	i := pool.pos[index]
+	last := len(pool.free) - 1
+	moved := pool.free[last]
+	pool.free[i] = moved
+	pool.pos[moved] = i
+	pool.free = pool.free[:last]
+	pool.pos[index] = -1
+}
+
 func (pool *DnsIPPool) Release(ip net.IP) {
 	index := tcpip.ConvertIPv4ToUint32(ip) - pool.base
-	if index < pool.space {
-		pool.flags[index] = false
+	if index < pool.space && pool.pos[index] < 0 {
+		pool.pos[index] = int32(len(pool.free))
+		pool.free = append(pool.free, index)
+	}
+}
+
+// mark ip as used, return false if ip is out of pool or already used
+func (pool *DnsIPPool) Reserve(ip net.IP) bool {
+	index := tcpip.ConvertIPv4ToUint32(ip) - pool.base
+	if index >= pool.space || pool.pos[index] < 0 {
+		return false
 	}
+	pool.take(index)
+	return true
 }
 
 // use tips as a hint to find a stable index
 func (pool *DnsIPPool) Alloc(tips string) net.IP {
-	index := adler32.Checksum([]byte(tips)) % pool.space
-	if pool.flags[index] {
-		logger.Debugf("[dns] %s is not in main index: %d", tips, index)
-		for i, used := range pool.flags {
-			if !used {
-				index = uint32(i)
-				break
-			}
-		}
+	if len(pool.free) == 0 {
+		return nil
 	}
 
-	if pool.flags[index] {
-		return nil
+	index := adler32.Checksum([]byte(tips)) % pool.space
+	if pool.pos[index] < 0 {
+		logger.Debugf("[dns] %s is not in main index: %d", tips, index)
+		index = pool.free[len(pool.free)-1]
 	}
-	pool.flags[index] = true
+	pool.take(index)
 	return tcpip.ConvertUint32ToIPv4(pool.base + index)
 }
 
-func NewDnsIPPool(ip net.IP, subnet *net.IPNet) *DnsIPPool {
+func (pool *DnsIPPool) MarshalJSON() ([]byte, error) {
+	return jsoniter.Marshal(map[string]interface{}{
+		"base":     tcpip.ConvertUint32ToIPv4(pool.base),
+		"capacity": pool.Capacity(),
+		"used":     pool.Used(),
+	})
+}
+
+func NewDnsIPPool(ip net.IP, subnet *net.IPNet, maxSpace uint32) *DnsIPPool {
 	// 地址池的起始地址为网段的第一个IP+1
 	base := tcpip.ConvertIPv4ToUint32(subnet.IP) + 1
 	// 地址池的结束地址为网段的广播IP+1
 	max := base + ^tcpip.ConvertIPv4ToUint32(net.IP(subnet.Mask)) - 1
 
-	// space should not over 0x3ffff
+	// space should not over maxSpace
 	space := max - base
-	if space > DnsIPPoolMaxSpace {
-		space = DnsIPPoolMaxSpace
+	if maxSpace == 0 {
+		maxSpace = DnsIPPoolMaxSpace
 	}
-	flags := make([]bool, space)
-
-	// ip is used by tun
-	index := tcpip.ConvertIPv4ToUint32(ip) - base
-	if index < space {
-		flags[index] = true
+	if space > maxSpace {
+		space = maxSpace
 	}
 
-	return &DnsIPPool{
+	pool := &DnsIPPool{
 		base:  base,
 		space: space,
-		flags: flags,
+		free:  make([]uint32, space),
+		pos:   make([]int32, space),
 	}
+	for i := uint32(0); i < space; i++ {
+		pool.free[i] = space - 1 - i
+		pool.pos[space-1-i] = int32(i)
+	}
+
+	// ip is used by tun
+	pool.Reserve(ip)
+	return pool
 }
@@ -0,0 +1,157 @@
+package k1
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/miekg/dns"
+	"github.com/nxsre/lumberjack"
+)
+
+const (
+	dnsQueryLogDefaultSize   = 1000
+	dnsQueryLogDefaultMaxAge = 7 // days
+)
+
+// how a query is answered
+const (
+	dnsDecisionHosts        = "hosts"          // answered by hosts
+	dnsDecisionReject       = "reject"         // rejected by rule
+	dnsDecisionFakeIPFilter = "fake-ip-filter" // real answer by fake ip filter
+	dnsDecisionNonProxy     = "non-proxy"      // real answer from backend dns
+	dnsDecisionCached       = "cached"         // fake ip of already hijacked domain
+	dnsDecisionProxy        = "proxy"          // hijacked to a proxy
+	dnsDecisionBlock        = "block"          // blocked query type of proxy domain
+	dnsDecisionFakeIP       = "fake-ip"        // PTR of fake ip
+)
+
+type DnsQueryLog struct {
+	Time     time.Time
+	Client   string
+	Name     string
+	Type     string
+	Decision string
+	Proxy    string
+	Upstream string
+	Rcode    string
+	Latency  time.Duration
+}
+
+func newDnsQueryLog(client net.Addr, q dns.Question) *DnsQueryLog {
+	ql := &DnsQueryLog{
+		Time: time.Now(),
+		Name: dns.Fqdn(q.Name),
+		Type: dns.Type(q.Qtype).String(),
+	}
+	if client != nil {
+		if host, _, err := net.SplitHostPort(client.String()); err == nil {
+			ql.Client = host
+		} else {
+			ql.Client = client.String()
+		}
+	}
+	return ql
+}
+
+func (ql *DnsQueryLog) done(rcode int) {
+	ql.Rcode = dns.RcodeToString[rcode]
+	ql.Latency = time.Since(ql.Time)
+}
+
+func (ql *DnsQueryLog) contains(keyword string) bool {
+	for _, v := range []string{ql.Client, ql.Name, ql.Type, ql.Decision, ql.Proxy, ql.Upstream, ql.Rcode} {
+		if strings.Contains(strings.ToLower(v), keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// recent dns queries in a ring buffer
+type DnsQueryLogs struct {
+	lock    sync.Mutex
+	entries []*DnsQueryLog
+	next    int  // next position to write
+	full    bool // ring buffer is wrapped
+
+	writer io.Writer // persist as json lines if not nil
+}
+
+func (l *DnsQueryLogs) Add(ql *DnsQueryLog) {
+	if l == nil {
+		return
+	}
+
+	// query-log-size 0 keeps no recent queries, the file is still written
+	if len(l.entries) > 0 {
+		l.lock.Lock()
+		l.entries[l.next] = ql
+		l.next++
+		if l.next == len(l.entries) {
+			l.next = 0
+			l.full = true
+		}
+		l.lock.Unlock()
+	}
+
+	if l.writer != nil {
+		data, err := jsoniter.Marshal(ql)
+		if err == nil {
+			_, err = l.writer.Write(append(data, '\n'))
+		}
+		if err != nil {
+			logger.Errorf("[dns] write query log failed: %v", err)
+		}
+	}
+}
+
+// search recent queries by keyword, newest first
+func (l *DnsQueryLogs) Search(keyword string, limit int) []*DnsQueryLog {
+	if l == nil || len(l.entries) == 0 {
+		return nil
+	}
+
+	keyword = strings.ToLower(strings.TrimSpace(keyword))
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	count := l.next
+	if l.full {
+		count = len(l.entries)
+	}
+
+	var result []*DnsQueryLog
+	for i := 1; i <= count; i++ {
+		ql := l.entries[(l.next-i+len(l.entries))%len(l.entries)]
+		if keyword != "" && !ql.contains(keyword) {
+			continue
+		}
+		result = append(result, ql)
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+	}
+	return result
+}
+
+func NewDnsQueryLogs(cfg DnsConfig) *DnsQueryLogs {
+	l := &DnsQueryLogs{
+		entries: make([]*DnsQueryLog, cfg.QueryLogSize),
+	}
+	if cfg.QueryLogFile != "" {
+		l.writer = &lumberjack.Logger{
+			Filename:   cfg.QueryLogFile,
+			TimeFormat: "2006-01-02",
+			MaxSize:    -1,
+			MaxAge:     int(cfg.QueryLogMaxAge),
+			LocalTime:  true,
+			Compress:   true,
+		}
+	}
+	return l
+}
@@ -0,0 +1,57 @@
+package k1
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDnsQueryLogs(t *testing.T) {
+	logs := NewDnsQueryLogs(DnsConfig{QueryLogSize: 3})
+	client := &net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 5353}
+
+	for i := 0; i < 5; i++ {
+		ql := newDnsQueryLog(client, dns.Question{Name: fmt.Sprintf("%d.example.com", i), Qtype: dns.TypeA})
+		ql.Decision = dnsDecisionNonProxy
+		if i%2 == 0 {
+			ql.Decision, ql.Proxy = dnsDecisionProxy, "B"
+		}
+		ql.done(dns.RcodeSuccess)
+		logs.Add(ql)
+	}
+
+	all := logs.Search("", 0)
+	if len(all) != 3 || all[0].Name != "4.example.com." || all[2].Name != "2.example.com." {
+		t.Fatalf("ring buffer: %+v", all)
+	}
+	if all[0].Client != "192.168.1.2" || all[0].Type != "A" || all[0].Rcode != "NOERROR" {
+		t.Fatalf("entry: %+v", all[0])
+	}
+
+	if found := logs.Search("3.EXAMPLE", 0); len(found) != 1 || found[0].Decision != dnsDecisionNonProxy {
+		t.Fatalf("search name: %+v", found)
+	}
+	if limited := logs.Search("example", 1); len(limited) != 1 {
+		t.Fatalf("search limit: %+v", limited)
+	}
+}
+
+func TestDnsQueryLogsFileOnly(t *testing.T) {
+	var buf bytes.Buffer
+	logs := NewDnsQueryLogs(DnsConfig{QueryLogSize: 0})
+	logs.writer = &buf
+
+	ql := newDnsQueryLog(&net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 5353}, dns.Question{Name: "example.com.", Qtype: dns.TypeA})
+	ql.done(dns.RcodeSuccess)
+	logs.Add(ql)
+	if len(logs.Search("", 0)) != 0 {
+		t.Error("no recent queries should be kept")
+	}
+	if !strings.Contains(buf.String(), "example.com.") {
+		t.Errorf("query should be written to file: %q", buf.String())
+	}
+}
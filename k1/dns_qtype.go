@@ -0,0 +1,289 @@
+package k1
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/miekg/dns/dnsutil"
+)
+
+// not defined in miekg/dns yet
+const (
+	dnsTypeSVCB  uint16 = 64
+	dnsTypeHTTPS uint16 = 65
+)
+
+// svc params carrying ip address
+const (
+	svcParamIPv4Hint = 4
+	svcParamIPv6Hint = 6
+)
+
+// policy of AAAA query for proxy domain
+const (
+	aaaaPolicyPass  = "pass"  // resolve by backend dns
+	aaaaPolicyEmpty = "empty" // empty answer, force client to use fake ipv4
+)
+
+// policy of HTTPS/SVCB query for proxy domain
+const (
+	httpsPolicyPass       = "pass"       // resolve by backend dns
+	httpsPolicyEmpty      = "empty"      // empty answer
+	httpsPolicyStrip      = "strip"      // remove ipv4hint and ipv6hint
+	httpsPolicySynthesize = "synthesize" // replace ipv4hint with fake ip, remove ipv6hint
+)
+
+func isValidAAAAPolicy(policy string) bool {
+	switch policy {
+	case aaaaPolicyPass, aaaaPolicyEmpty:
+		return true
+	}
+	return false
+}
+
+func isValidHTTPSPolicy(policy string) bool {
+	switch policy {
+	case httpsPolicyPass, httpsPolicyEmpty, httpsPolicyStrip, httpsPolicySynthesize:
+		return true
+	}
+	return false
+}
+
+// parse query type, eg: AAAA, HTTPS, TYPE65
+func parseQtype(name string) (uint16, error) {
+	name = strings.ToUpper(name)
+	switch name {
+	case "SVCB":
+		return dnsTypeSVCB, nil
+	case "HTTPS":
+		return dnsTypeHTTPS, nil
+	}
+	if qtype, ok := dns.StringToType[name]; ok {
+		return qtype, nil
+	}
+	if strings.HasPrefix(name, "TYPE") {
+		if v, err := strconv.ParseUint(name[4:], 10, 16); err == nil {
+			return uint16(v), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown query type: %s", name)
+}
+
+func emptyAnswer(request *dns.Msg) *dns.Msg {
+	rsp := new(dns.Msg)
+	rsp.SetReply(request)
+	rsp.RecursionAvailable = true
+	return rsp
+}
+
+// hijacked record of proxy domain for client src, nil if it's not a proxy domain
+func (d *Dns) proxyRecord(src net.IP, domain string) *DomainRecord {
+	one := d.one
+
+	if d.matchFakeIPFilter(domain) {
+		return nil
+	}
+	if record, pattern := d.sourceRecord(src, domain); pattern != nil {
+		return record
+	}
+
+	if record := one.dnsTable.Get(domain); record != nil && !record.Source {
+		return record
+	}
+
+	if one.dnsTable.IsNonProxyDomain(domain) {
+		return nil
+	}
+
+	if matched, proxy := one.rules.Load().Proxy(domain); matched && proxy != "" {
+		record := one.dnsTable.Set(domain, proxy)
+		if record != nil {
+			r := new(dns.Msg)
+			r.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+			go d.fillRealIP(record, r)
+		}
+		return record
+	}
+	return nil
+}
+
+// parse ipv4 from reverse name, eg: 2.0.18.198.in-addr.arpa.
+func parseReverseIPv4(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+	if !strings.HasSuffix(name, ".in-addr.arpa.") {
+		return nil
+	}
+	labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+	if len(labels) != net.IPv4len {
+		return nil
+	}
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return net.ParseIP(strings.Join(labels, ".")).To4()
+}
+
+// answer PTR query of fake ip locally, never leak it to backend dns
+func (d *Dns) doPTRQuery(r *dns.Msg, ip net.IP) *dns.Msg {
+	rsp := emptyAnswer(r)
+	domain, ok := d.one.dnsTable.LookupIP(ip)
+	if !ok {
+		rsp.Rcode = dns.RcodeNameError
+		return rsp
+	}
+
+	rr := new(dns.PTR)
+	rr.Hdr = dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: d.one.dnsTable.ttl}
+	rr.Ptr = dns.Fqdn(domain)
+	rsp.Answer = append(rsp.Answer, rr)
+	return rsp
+}
+
+// non A query
+func (d *Dns) doOtherQuery(r *dns.Msg, ql *DnsQueryLog) (*dns.Msg, error) {
+	q := r.Question[0]
+	ql.Decision = dnsDecisionNonProxy
+	if q.Qclass != dns.ClassINET {
+		return d.resolveLog(r, ql)
+	}
+
+	if q.Qtype == dns.TypePTR {
+		if ip := parseReverseIPv4(q.Name); ip != nil && d.one.dnsTable.Contains(ip) {
+			ql.Decision = dnsDecisionFakeIP
+			return d.doPTRQuery(r, ip), nil
+		}
+		return d.resolveLog(r, ql)
+	}
+
+	// reject domain never reaches backend dns, same as A query
+	domain := dnsutil.TrimDomainName(q.Name, ".")
+	src := net.ParseIP(ql.Client)
+	if d.one.rules.Load().RejectFrom(src, domain) {
+		ql.Decision = dnsDecisionReject
+		return nil, errors.New(domain + " is a reject domain")
+	}
+
+	record := d.proxyRecord(src, domain)
+	if record == nil {
+		return d.resolveLog(r, ql)
+	}
+
+	ql.Decision, ql.Proxy = dnsDecisionProxy, record.Proxy
+	if d.blockQtypes[q.Qtype] {
+		logger.Debugf("[dns] block %s %s", dns.Type(q.Qtype), domain)
+		ql.Decision = dnsDecisionBlock
+		return emptyAnswer(r), nil
+	}
+
+	switch q.Qtype {
+	case dns.TypeAAAA:
+		if d.aaaaPolicy == aaaaPolicyEmpty {
+			return emptyAnswer(r), nil
+		}
+	case dnsTypeHTTPS, dnsTypeSVCB:
+		switch d.httpsPolicy {
+		case httpsPolicyEmpty:
+			return emptyAnswer(r), nil
+		case httpsPolicyStrip:
+			return d.resolveSVCB(r, nil, ql)
+		case httpsPolicySynthesize:
+			return d.resolveSVCB(r, record.IP, ql)
+		}
+	}
+	return d.resolveLog(r, ql)
+}
+
+// resolve HTTPS/SVCB and rewrite ip hints, so clients never see real address
+func (d *Dns) resolveSVCB(r *dns.Msg, ip net.IP, ql *DnsQueryLog) (*dns.Msg, error) {
+	msg, err := d.resolveLog(r, ql)
+	if err != nil {
+		return msg, err
+	}
+
+	rewrite := func(rrs []dns.RR) []dns.RR {
+		var out []dns.RR
+		for _, rr := range rrs {
+			switch v := rr.(type) {
+			case *dns.A, *dns.AAAA:
+				continue
+			case *dns.RFC3597:
+				if v.Hdr.Rrtype == dnsTypeHTTPS || v.Hdr.Rrtype == dnsTypeSVCB {
+					if err := rewriteSVCBHints(v, ip); err != nil {
+						logger.Debugf("[dns] rewrite %s failed: %v", v.Hdr.Name, err)
+						continue
+					}
+				}
+			}
+			out = append(out, rr)
+		}
+		return out
+	}
+
+	msg.Answer = rewrite(msg.Answer)
+	msg.Extra = rewrite(msg.Extra)
+	return msg, nil
+}
+
+// rewrite svc params in rdata(RFC 9460): ipv6hint is removed, ipv4hint is
+// replaced with ip or removed if ip is nil
+func rewriteSVCBHints(rr *dns.RFC3597, ip net.IP) error {
+	rdata, err := hex.DecodeString(rr.Rdata)
+	if err != nil {
+		return err
+	}
+
+	// SvcPriority
+	if len(rdata) < 2 {
+		return fmt.Errorf("bad svcb rdata")
+	}
+	off := 2
+
+	// TargetName, uncompressed
+	for {
+		if off >= len(rdata) {
+			return fmt.Errorf("bad svcb target name")
+		}
+		l := int(rdata[off])
+		off += 1 + l
+		if l == 0 {
+			break
+		}
+	}
+	if off > len(rdata) {
+		return fmt.Errorf("bad svcb target name")
+	}
+
+	out := append([]byte(nil), rdata[:off]...)
+	for off < len(rdata) {
+		if off+4 > len(rdata) {
+			return fmt.Errorf("bad svc param")
+		}
+		key := int(rdata[off])<<8 | int(rdata[off+1])
+		l := int(rdata[off+2])<<8 | int(rdata[off+3])
+		end := off + 4 + l
+		if end > len(rdata) {
+			return fmt.Errorf("bad svc param")
+		}
+
+		switch key {
+		case svcParamIPv4Hint:
+			if ip4 := ip.To4(); ip4 != nil {
+				out = append(out, rdata[off], rdata[off+1], 0, net.IPv4len)
+				out = append(out, ip4...)
+			}
+		case svcParamIPv6Hint:
+		default:
+			out = append(out, rdata[off:end]...)
+		}
+		off = end
+	}
+
+	rr.Rdata = hex.EncodeToString(out)
+	rr.Hdr.Rdlength = uint16(len(out))
+	return nil
+}
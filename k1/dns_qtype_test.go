@@ -0,0 +1,96 @@
+package k1
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRewriteSVCBHints(t *testing.T) {
+	rdata := []byte{
+		0, 1, // priority
+		0,                       // target name "."
+		0, 1, 0, 3, 2, 'h', '2', // alpn=h2
+		0, 4, 0, 8, 1, 2, 3, 4, 5, 6, 7, 8, // ipv4hint=1.2.3.4,5.6.7.8
+		0, 6, 0, 16, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, // ipv6hint=::1
+	}
+
+	cases := []struct {
+		ip       net.IP
+		expected []byte
+	}{
+		{nil, rdata[:10]},
+		{net.ParseIP("198.18.0.2"), append(append([]byte(nil), rdata[:10]...), 0, 4, 0, 4, 198, 18, 0, 2)},
+	}
+
+	for _, c := range cases {
+		rr := &dns.RFC3597{
+			Hdr:   dns.RR_Header{Name: "example.com.", Rrtype: dnsTypeHTTPS, Class: dns.ClassINET},
+			Rdata: hex.EncodeToString(rdata),
+		}
+		if err := rewriteSVCBHints(rr, c.ip); err != nil {
+			t.Fatal(err)
+		}
+		if rr.Rdata != hex.EncodeToString(c.expected) {
+			t.Errorf("rewrite with %v failed: %s", c.ip, rr.Rdata)
+		}
+	}
+
+	bad := &dns.RFC3597{Rdata: hex.EncodeToString([]byte{0, 1, 3, 'c', 'o'})}
+	if rewriteSVCBHints(bad, nil) == nil {
+		t.Error("bad rdata should fail")
+	}
+}
+
+func TestParseQtype(t *testing.T) {
+	cases := map[string]uint16{
+		"AAAA":   dns.TypeAAAA,
+		"https":  dnsTypeHTTPS,
+		"SVCB":   dnsTypeSVCB,
+		"TYPE66": 66,
+	}
+	for name, expected := range cases {
+		if qtype, err := parseQtype(name); err != nil || qtype != expected {
+			t.Errorf("parse %s failed: %d, %v", name, qtype, err)
+		}
+	}
+	if _, err := parseQtype("NOPE"); err == nil {
+		t.Error("parse unknown type should fail")
+	}
+}
+
+func TestParseReverseIPv4(t *testing.T) {
+	cases := map[string]string{
+		"2.0.18.198.in-addr.arpa.": "198.18.0.2",
+		"2.0.18.198.IN-ADDR.ARPA":  "198.18.0.2",
+		"0.18.198.in-addr.arpa.":   "",
+		"2.0.18.198.example.com.":  "",
+		"x.0.18.198.in-addr.arpa.": "",
+	}
+	for name, expected := range cases {
+		ip := parseReverseIPv4(name)
+		if (expected == "" && ip != nil) || (expected != "" && !ip.Equal(net.ParseIP(expected))) {
+			t.Errorf("parse %s failed: %v", name, ip)
+		}
+	}
+}
+
+func TestRejectOtherQuery(t *testing.T) {
+	one := testRelayOne()
+	patterns := map[string]*PatternConfig{
+		"ads": {Policy: REJECT_POLICY, Scheme: schemeDomainSuffix, V: []string{"ads.example.com"}},
+	}
+	one.rules = NewRuleSet(RuleConfig{Pattern: []string{"ads"}}, patterns, nil)
+	d := &Dns{one: one}
+
+	for _, qtype := range []uint16{dns.TypeAAAA, dnsTypeHTTPS, dnsTypeSVCB, dns.TypeTXT} {
+		r := new(dns.Msg)
+		r.SetQuestion("www.ads.example.com.", qtype)
+		ql := newDnsQueryLog(&net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 5353}, r.Question[0])
+		if msg, err := d.doOtherQuery(r, ql); err == nil || msg != nil || ql.Decision != dnsDecisionReject {
+			t.Errorf("%s query of reject domain: %v %v %s", dns.Type(qtype), msg, err, ql.Decision)
+		}
+	}
+}
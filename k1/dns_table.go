@@ -1,10 +1,15 @@
 package k1
 
 import (
+	"container/list"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
+	jsoniter "github.com/json-iterator/go"
 	"github.com/miekg/dns"
 )
 
@@ -17,25 +22,10 @@ type DomainRecord struct {
 	RealIP  net.IP // real ip
 	Hits    int
 	Expires time.Time
+	Source  bool // hijacked only for clients matching source patterns
 
-	answer *dns.A // cache dns answer
-}
-
-func (record *DomainRecord) SetRealIP(msg *dns.Msg) {
-	if record.RealIP != nil {
-		return
-	}
-
-	var ip net.IP
-	for _, item := range msg.Answer {
-		switch answer := item.(type) {
-		case *dns.A:
-			ip = answer.A
-			break
-		}
-	}
-	record.RealIP = ip
-	logger.Debugf("[dns] %s real ip: %s", record.Hostname, ip)
+	answer *dns.A        // cache dns answer
+	elem   *list.Element // position in lru list
 }
 
 func (record *DomainRecord) Answer(request *dns.Msg) *dns.Msg {
@@ -46,19 +36,33 @@ func (record *DomainRecord) Answer(request *dns.Msg) *dns.Msg {
 	return rsp
 }
 
-func (record *DomainRecord) Touch() {
+func (record *DomainRecord) Touch(lifetime time.Duration) {
 	record.Hits++
-	record.Expires = time.Now().Add(dnsDefaultTtl * time.Second)
+	record.Expires = time.Now().Add(lifetime)
 }
 
 type DnsTable struct {
 	// dns ip pool
 	ipPool *DnsIPPool
+	subnet *net.IPNet
+
+	// snapshot of hijacked domain records, keep fake ip stable across restarts
+	cacheFile string
+
+	ttl            uint32        // ttl of fake ip answer
+	lifetime       time.Duration // idle lifetime of hijacked domain record
+	sweepInterval  time.Duration
+	sweepThreshold int // min count of records to sweep
+
+	// fake ip has active nat sessions, never recycle it
+	inUse func(ip net.IP) bool
 
 	// hijacked domain records
 	records     map[string]*DomainRecord // domain -> record
 	ip2Domain   map[string]string        // ip -> domain: map hijacked ip address to domain
-	recordsLock sync.Mutex               // protect records and ip2Domain
+	lru         *list.List               // records, most recently used first
+	evicted     int                      // records evicted for ip space
+	recordsLock sync.Mutex               // protect records, ip2Domain and lru
 
 	nonProxyDomains map[string]time.Time // non proxy domain
 	npdLock         sync.Mutex           // protect non proxy domain
@@ -67,7 +71,8 @@ type DnsTable struct {
 func (c *DnsTable) get(domain string) *DomainRecord {
 	record := c.records[domain]
 	if record != nil {
-		record.Touch()
+		record.Touch(c.lifetime)
+		c.lru.MoveToFront(record.elem)
 	}
 	return record
 }
@@ -81,6 +86,39 @@ func (c *DnsTable) GetByIP(ip net.IP) *DomainRecord {
 	return nil
 }
 
+// real ip of record from answer of backend dns, set once. record may be
+// saved or read by relays meanwhile
+func (c *DnsTable) SetRealIP(record *DomainRecord, msg *dns.Msg) {
+	var ip net.IP
+	for _, item := range msg.Answer {
+		if answer, ok := item.(*dns.A); ok {
+			ip = answer.A
+		}
+	}
+
+	c.recordsLock.Lock()
+	defer c.recordsLock.Unlock()
+	if record.RealIP != nil {
+		return
+	}
+	record.RealIP = ip
+	logger.Debugf("[dns] %s real ip: %s", record.Hostname, ip)
+}
+
+func (c *DnsTable) RealIP(record *DomainRecord) net.IP {
+	c.recordsLock.Lock()
+	defer c.recordsLock.Unlock()
+	return record.RealIP
+}
+
+// domain of hijacked ip, without touching the record
+func (c *DnsTable) LookupIP(ip net.IP) (string, bool) {
+	c.recordsLock.Lock()
+	defer c.recordsLock.Unlock()
+	domain, ok := c.ip2Domain[ip.String()]
+	return domain, ok
+}
+
 func (c *DnsTable) Contains(ip net.IP) bool {
 	return c.ipPool.Contains(ip)
 }
@@ -92,23 +130,37 @@ func (c *DnsTable) Get(domain string) *DomainRecord {
 }
 
 // forge a IPv4 dns reply
-func forgeIPv4Answer(domain string, ip net.IP) *dns.A {
+func forgeIPv4Answer(domain string, ip net.IP, ttl uint32) *dns.A {
 	rr := new(dns.A)
-	rr.Hdr = dns.RR_Header{Name: dns.Fqdn(domain), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: dnsDefaultTtl}
+	rr.Hdr = dns.RR_Header{Name: dns.Fqdn(domain), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}
 	rr.A = ip.To4()
 	return rr
 }
 
 func (c *DnsTable) Set(domain string, proxy string) *DomainRecord {
+	return c.set(domain, proxy, false)
+}
+
+// hijack domain for clients matching source patterns only,
+// proxy is decided by domain for other clients
+func (c *DnsTable) SetSource(domain string, proxy string) *DomainRecord {
+	return c.set(domain, proxy, true)
+}
+
+func (c *DnsTable) set(domain string, proxy string, source bool) *DomainRecord {
 	c.recordsLock.Lock()
 	defer c.recordsLock.Unlock()
 	record := c.records[domain]
 	if record != nil {
+		record.Source = record.Source && source
 		return record
 	}
 
-	// alloc a ip
+	// alloc a ip, reuse the least recently used one if ip space is used up
 	ip := c.ipPool.Alloc(domain)
+	if ip == nil {
+		ip = c.evict()
+	}
 	if ip == nil {
 		logger.Errorf("[dns] ip space is used up, domain:%s", domain)
 		return nil
@@ -118,16 +170,51 @@ func (c *DnsTable) Set(domain string, proxy string) *DomainRecord {
 	record.IP = ip
 	record.Hostname = domain
 	record.Proxy = proxy
-	record.answer = forgeIPv4Answer(domain, ip)
+	record.Source = source
+	record.answer = forgeIPv4Answer(domain, ip, c.ttl)
 
-	record.Touch()
+	record.Touch(c.lifetime)
 
 	c.records[domain] = record
 	c.ip2Domain[ip.String()] = domain
+	record.elem = c.lru.PushFront(record)
 	logger.Debugf("[dns] hijack %s -> %s", domain, ip.String())
 	return record
 }
 
+func (c *DnsTable) remove(record *DomainRecord) {
+	delete(c.records, record.Hostname)
+	delete(c.ip2Domain, record.IP.String())
+	c.lru.Remove(record.elem)
+}
+
+func (c *DnsTable) isInUse(ip net.IP) bool {
+	return c.inUse != nil && c.inUse(ip)
+}
+
+// evict the least recently used record not in use and take over its ip
+func (c *DnsTable) evict() net.IP {
+	elem := c.lru.Back()
+	for elem != nil && c.isInUse(elem.Value.(*DomainRecord).IP) {
+		elem = elem.Prev()
+	}
+	if elem == nil {
+		return nil
+	}
+	record := elem.Value.(*DomainRecord)
+	c.remove(record)
+	c.evicted++
+	logger.Infof("[dns] evict %s -> %s, hit: %d", record.Hostname, record.IP.String(), record.Hits)
+	return record.IP
+}
+
+// ip pool usage
+func (c *DnsTable) PoolStats() (used, capacity, evicted int) {
+	c.recordsLock.Lock()
+	defer c.recordsLock.Unlock()
+	return c.ipPool.Used(), c.ipPool.Capacity(), c.evicted
+}
+
 func (c *DnsTable) IsNonProxyDomain(domain string) bool {
 	c.npdLock.Lock()
 	defer c.npdLock.Unlock()
@@ -157,7 +244,7 @@ func (c *DnsTable) clearExpiredDomain(now time.Time) {
 	c.recordsLock.Lock()
 	defer c.recordsLock.Unlock()
 
-	threshold := 1000
+	threshold := c.sweepThreshold
 	if threshold > c.ipPool.Capacity()/10 {
 		threshold = c.ipPool.Capacity() / 10
 	}
@@ -170,27 +257,153 @@ func (c *DnsTable) clearExpiredDomain(now time.Time) {
 		if !record.Expires.Before(now) {
 			continue
 		}
-		delete(c.records, domain)
-		delete(c.ip2Domain, record.IP.String())
+		if c.isInUse(record.IP) {
+			record.Expires = now.Add(c.lifetime)
+			continue
+		}
+		c.remove(record)
 		c.ipPool.Release(record.IP)
 		logger.Debugf("[dns] release %s -> %s, hit: %d", domain, record.IP.String(), record.Hits)
 	}
 }
 
+type dnsTableSnapshot struct {
+	Network string
+	Records []*DomainRecord
+}
+
+// save hijacked domain records to cache file
+// write to a temp file first, avoid corrupting file on crash
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (c *DnsTable) Save() error {
+	if c.cacheFile == "" {
+		return nil
+	}
+
+	c.recordsLock.Lock()
+	snapshot := dnsTableSnapshot{
+		Network: c.subnet.String(),
+		Records: make([]*DomainRecord, 0, len(c.records)),
+	}
+	// most recently used first
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		r := *elem.Value.(*DomainRecord)
+		snapshot.Records = append(snapshot.Records, &r)
+	}
+	c.recordsLock.Unlock()
+
+	data, err := jsoniter.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(c.cacheFile, data); err != nil {
+		return err
+	}
+	logger.Debugf("[dns] save %d records to %s", len(snapshot.Records), c.cacheFile)
+	return nil
+}
+
+// load hijacked domain records from cache file
+func (c *DnsTable) Load() error {
+	if c.cacheFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(c.cacheFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var snapshot dnsTableSnapshot
+	if err := jsoniter.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+
+	// fake ip is meaningless in another network
+	if snapshot.Network != c.subnet.String() {
+		logger.Infof("[dns] network changed %s -> %s, drop cache file %s", snapshot.Network, c.subnet, c.cacheFile)
+		return nil
+	}
+
+	c.recordsLock.Lock()
+	defer c.recordsLock.Unlock()
+
+	now := time.Now()
+	loaded := 0
+	for _, record := range snapshot.Records {
+		if record.Hostname == "" || record.Expires.Before(now) {
+			continue
+		}
+		if _, ok := c.records[record.Hostname]; ok {
+			continue
+		}
+		ip := record.IP.To4()
+		if ip == nil || !c.ipPool.Reserve(ip) {
+			logger.Debugf("[dns] drop cached record %s -> %s", record.Hostname, record.IP)
+			continue
+		}
+
+		record.IP = ip
+		record.answer = forgeIPv4Answer(record.Hostname, ip, c.ttl)
+		c.records[record.Hostname] = record
+		c.ip2Domain[ip.String()] = record.Hostname
+		record.elem = c.lru.PushBack(record)
+		loaded++
+	}
+	logger.Infof("[dns] load %d records from %s", loaded, c.cacheFile)
+	return nil
+}
+
 func (c *DnsTable) Serve() error {
-	tick := time.Tick(60 * time.Second)
+	tick := time.Tick(c.sweepInterval)
 	for now := range tick {
 		c.clearExpiredDomain(now)
 		c.clearExpiredNonProxyDomain(now)
+		if err := c.Save(); err != nil {
+			logger.Errorf("[dns] save cache file failed: %v", err)
+		}
 	}
 	return nil
 }
 
-func NewDnsTable(ip net.IP, subnet *net.IPNet) *DnsTable {
+func NewDnsTable(ip net.IP, subnet *net.IPNet, cfg DnsConfig) *DnsTable {
 	c := new(DnsTable)
-	c.ipPool = NewDnsIPPool(ip, subnet)
+	c.ipPool = NewDnsIPPool(ip, subnet, cfg.FakeIPSpace)
+	c.subnet = subnet
+	c.cacheFile = cfg.CacheFile
+	c.ttl = uint32(cfg.DnsTtl)
+	c.lifetime = time.Duration(cfg.RecordLifetime) * time.Second
+	c.sweepInterval = time.Duration(cfg.SweepInterval) * time.Second
+	c.sweepThreshold = int(cfg.SweepThreshold)
 	c.records = make(map[string]*DomainRecord)
 	c.ip2Domain = make(map[string]string)
+	c.lru = list.New()
 	c.nonProxyDomains = make(map[string]time.Time)
+	if err := c.Load(); err != nil {
+		logger.Errorf("[dns] load cache file failed: %v", err)
+	}
 	return c
 }
@@ -0,0 +1,165 @@
+package k1
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDnsTableCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ip, subnet, _ := net.ParseCIDR("198.18.0.1/24")
+	cfg := DnsConfig{CacheFile: filepath.Join(dir, "dns.cache"), RecordLifetime: 600}
+
+	table := NewDnsTable(ip, subnet, cfg)
+	record := table.Set("example.com", "A")
+	if record == nil {
+		t.Fatal("hijack domain failed")
+	}
+	if err := table.Save(); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	// restart
+	table = NewDnsTable(ip, subnet, cfg)
+	loaded := table.GetByIP(record.IP)
+	if loaded == nil || loaded.Hostname != "example.com" || loaded.Proxy != "A" {
+		t.Fatalf("load record failed: %+v", loaded)
+	}
+	if table.ipPool.Reserve(record.IP) {
+		t.Fatal("loaded ip is not reserved")
+	}
+
+	// another network drops the cache
+	ip, subnet, _ = net.ParseCIDR("198.19.0.1/24")
+	table = NewDnsTable(ip, subnet, cfg)
+	if table.Get("example.com") != nil {
+		t.Fatal("cache of another network should be dropped")
+	}
+}
+
+func TestDnsTableEvict(t *testing.T) {
+	ip, subnet, _ := net.ParseCIDR("198.18.0.1/24")
+	table := NewDnsTable(ip, subnet, DnsConfig{FakeIPSpace: 3})
+
+	// tun ip takes one of the space
+	a := table.Set("a.com", "A")
+	b := table.Set("b.com", "A")
+	if a == nil || b == nil {
+		t.Fatal("hijack domain failed")
+	}
+
+	table.Get("a.com")
+	c := table.Set("c.com", "A")
+	if c == nil || !c.IP.Equal(b.IP) {
+		t.Fatalf("c.com should take over ip of b.com: %v", c)
+	}
+	if table.Get("b.com") != nil || table.Get("a.com") == nil {
+		t.Fatal("least recently used record should be evicted")
+	}
+
+	if used, capacity, evicted := table.PoolStats(); used != 3 || capacity != 3 || evicted != 1 {
+		t.Fatalf("pool stats: used %d, capacity %d, evicted %d", used, capacity, evicted)
+	}
+}
+
+func TestDnsTableInUse(t *testing.T) {
+	ip, subnet, _ := net.ParseCIDR("198.18.0.1/24")
+	table := NewDnsTable(ip, subnet, DnsConfig{FakeIPSpace: 3, DnsTtl: 30, SweepThreshold: 1})
+
+	nat := NewNat(10000, 10010)
+	table.inUse = nat.IsActive
+
+	a := table.Set("a.com", "A")
+	b := table.Set("b.com", "A")
+	if a.answer.Hdr.Ttl != 30 {
+		t.Fatalf("ttl of fake answer: %d", a.answer.Hdr.Ttl)
+	}
+	nat.allocSession(net.ParseIP("192.168.1.2").To4(), a.IP, 12345, 443)
+
+	// a.com is least recently used but in use
+	c := table.Set("c.com", "A")
+	if c == nil || !c.IP.Equal(b.IP) {
+		t.Fatalf("c.com should take over ip of b.com: %v", c)
+	}
+
+	// all ip in use
+	nat.allocSession(net.ParseIP("192.168.1.2").To4(), c.IP, 12346, 443)
+	if table.Set("d.com", "A") != nil {
+		t.Fatal("ip in use should never be evicted")
+	}
+
+	// expired but in use
+	table.clearExpiredDomain(time.Now().Add(time.Hour))
+	if table.Get("a.com") == nil || table.Get("c.com") == nil {
+		t.Fatal("record in use should not be released")
+	}
+
+	table.inUse = nil
+	table.clearExpiredDomain(time.Now().Add(time.Hour))
+	if table.Get("a.com") != nil {
+		t.Fatal("expired record should be released")
+	}
+}
+
+func TestDnsTableSource(t *testing.T) {
+	ip, subnet, _ := net.ParseCIDR("198.18.0.1/24")
+	table := NewDnsTable(ip, subnet, DnsConfig{FakeIPSpace: 3})
+
+	record := table.SetSource("a.com", "B")
+	if record == nil || !record.Source {
+		t.Fatalf("hijack for source failed: %+v", record)
+	}
+	if table.SetSource("a.com", "B") != record || !record.Source {
+		t.Fatal("hijack for source again")
+	}
+	// hijacked by domain for all clients
+	if table.Set("a.com", "B") != record || record.Source {
+		t.Fatal("hijack by domain should clear source flag")
+	}
+	if table.SetSource("a.com", "B"); record.Source {
+		t.Fatal("record hijacked by domain is shared")
+	}
+}
+
+// run with -race, real ip is filled while the table is saved
+func TestDnsTableSaveRealIP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ip, subnet, _ := net.ParseCIDR("198.18.0.1/24")
+	cfg := DnsConfig{CacheFile: filepath.Join(dir, "dns.cache"), RecordLifetime: 600}
+	table := NewDnsTable(ip, subnet, cfg)
+	record := table.Set("example.com", "A")
+
+	msg := new(dns.Msg)
+	msg.Answer = append(msg.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA}, A: net.ParseIP("93.184.216.34").To4()})
+	done := make(chan struct{})
+	go func() {
+		table.SetRealIP(record, msg)
+		close(done)
+	}()
+	table.Save()
+	<-done
+	if err := table.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	table = NewDnsTable(ip, subnet, cfg)
+	if loaded := table.GetByIP(record.IP); loaded == nil || !table.RealIP(loaded).Equal(net.ParseIP("93.184.216.34")) {
+		t.Fatalf("real ip should be saved: %+v", loaded)
+	}
+}
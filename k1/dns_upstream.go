@@ -0,0 +1,124 @@
+package k1
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how to pick backend dns
+const (
+	upstreamStrategyOrdered    = "ordered"     // config order
+	upstreamStrategyFastest    = "fastest"     // lowest ewma rtt first
+	upstreamStrategyParallel   = "parallel"    // query all at once
+	upstreamStrategyRoundRobin = "round-robin" // rotate the first one
+)
+
+const (
+	upstreamStagger   = 100 * time.Millisecond // delay before asking next backend dns
+	upstreamEwmaAlpha = 0.2
+)
+
+func isValidUpstreamStrategy(strategy string) bool {
+	switch strategy {
+	case upstreamStrategyOrdered, upstreamStrategyFastest, upstreamStrategyParallel, upstreamStrategyRoundRobin:
+		return true
+	}
+	return false
+}
+
+// statistical data of a backend dns
+type UpstreamStats struct {
+	Nameserver string
+	Queries    int64
+	Errors     int64
+	Timeouts   int64
+	Rtt        time.Duration // ewma of rtt, errors count as timeout
+	LastError  string
+	LastUsed   time.Time
+}
+
+type upstreamTracker struct {
+	lock  sync.Mutex
+	stats UpstreamStats
+
+	penalty time.Duration // rtt sample of failed query
+}
+
+func (t *upstreamTracker) observe(rtt time.Duration, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	s := &t.stats
+	s.Queries++
+	s.LastUsed = time.Now()
+	if err != nil {
+		if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+			s.Timeouts++
+		} else {
+			s.Errors++
+		}
+		s.LastError = err.Error()
+		rtt = t.penalty
+	}
+
+	if s.Rtt == 0 {
+		s.Rtt = rtt
+	} else {
+		s.Rtt = time.Duration(float64(s.Rtt)*(1-upstreamEwmaAlpha) + float64(rtt)*upstreamEwmaAlpha)
+	}
+}
+
+func (t *upstreamTracker) Stats() UpstreamStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.stats
+}
+
+// order of backend dns to query
+func (d *Dns) upstreams() []string {
+	switch d.strategy {
+	case upstreamStrategyFastest:
+		type item struct {
+			ns  string
+			rtt time.Duration
+		}
+		items := make([]item, len(d.nameservers))
+		for i, ns := range d.nameservers {
+			items[i] = item{ns, d.clients[ns].tracker.Stats().Rtt}
+		}
+		// untested one goes first
+		sort.SliceStable(items, func(i, j int) bool {
+			return items[i].rtt < items[j].rtt
+		})
+		nameservers := make([]string, len(items))
+		for i, v := range items {
+			nameservers[i] = v.ns
+		}
+		return nameservers
+	case upstreamStrategyRoundRobin:
+		n := len(d.nameservers)
+		start := int(atomic.AddUint32(&d.next, 1) % uint32(n))
+		nameservers := make([]string, 0, n)
+		nameservers = append(nameservers, d.nameservers[start:]...)
+		return append(nameservers, d.nameservers[:start]...)
+	}
+	return d.nameservers
+}
+
+func (d *Dns) stagger() time.Duration {
+	if d.strategy == upstreamStrategyParallel {
+		return 0
+	}
+	return upstreamStagger
+}
+
+func (d *Dns) UpstreamStats() []UpstreamStats {
+	stats := make([]UpstreamStats, 0, len(d.nameservers))
+	for _, ns := range d.nameservers {
+		stats = append(stats, d.clients[ns].tracker.Stats())
+	}
+	return stats
+}
@@ -0,0 +1,43 @@
+package k1
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUpstreamStrategy(t *testing.T) {
+	cfg := DnsConfig{
+		Nameserver:     []string{"1.1.1.1:53", "2.2.2.2:53", "3.3.3.3:53"},
+		DnsReadTimeout: 1,
+	}
+	d := &Dns{
+		clients:     GetDnsClients(cfg),
+		nameservers: cfg.Nameserver,
+	}
+
+	d.clients["1.1.1.1:53"].tracker.observe(0, errors.New("refused"))
+	d.clients["2.2.2.2:53"].tracker.observe(50*time.Millisecond, nil)
+	d.clients["3.3.3.3:53"].tracker.observe(10*time.Millisecond, nil)
+
+	d.strategy = upstreamStrategyOrdered
+	if ns := d.upstreams(); ns[0] != "1.1.1.1:53" {
+		t.Errorf("ordered: %v", ns)
+	}
+
+	d.strategy = upstreamStrategyFastest
+	if ns := d.upstreams(); ns[0] != "3.3.3.3:53" || ns[2] != "1.1.1.1:53" {
+		t.Errorf("fastest: %v", ns)
+	}
+
+	d.strategy = upstreamStrategyRoundRobin
+	first := d.upstreams()[0]
+	if second := d.upstreams()[0]; first == second {
+		t.Errorf("round-robin: %s, %s", first, second)
+	}
+
+	stats := d.UpstreamStats()
+	if stats[0].Errors != 1 || stats[0].Rtt != time.Second || stats[1].Queries != 1 {
+		t.Errorf("stats: %+v", stats)
+	}
+}
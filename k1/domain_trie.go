@@ -0,0 +1,306 @@
+package k1
+
+import (
+	"sort"
+	"strings"
+)
+
+// lower case of ascii domain, no allocation if it's already lower case
+func lowerASCII(s string) string {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; 'A' <= c && c <= 'Z' {
+			return strings.ToLower(s)
+		}
+	}
+	return s
+}
+
+// trie of domain suffixes by reversed labels, eg: com -> example -> www
+type SuffixTrie struct {
+	root *suffixNode
+}
+
+type suffixNode struct {
+	end      bool // a suffix ends here
+	children map[string]*suffixNode
+}
+
+func NewSuffixTrie() *SuffixTrie {
+	return &SuffixTrie{root: new(suffixNode)}
+}
+
+func (t *SuffixTrie) Insert(suffix string) {
+	suffix = strings.ToLower(suffix)
+	n := t.root
+	for end := len(suffix); end >= 0; {
+		start := strings.LastIndexByte(suffix[:end], '.') + 1
+		label := suffix[start:end]
+		child := n.children[label]
+		if child == nil {
+			if n.children == nil {
+				n.children = make(map[string]*suffixNode)
+			}
+			child = new(suffixNode)
+			n.children[label] = child
+		}
+		n = child
+		end = start - 1
+	}
+	n.end = true
+}
+
+func (t *SuffixTrie) Remove(suffix string) {
+	suffix = strings.ToLower(suffix)
+
+	// path from root, to prune empty nodes
+	path := []*suffixNode{t.root}
+	var labels []string
+	n := t.root
+	for end := len(suffix); end >= 0; {
+		start := strings.LastIndexByte(suffix[:end], '.') + 1
+		label := suffix[start:end]
+		if n = n.children[label]; n == nil {
+			return
+		}
+		path = append(path, n)
+		labels = append(labels, label)
+		end = start - 1
+	}
+
+	n.end = false
+	for i := len(path) - 1; i > 0; i-- {
+		if n := path[i]; n.end || len(n.children) > 0 {
+			break
+		}
+		delete(path[i-1].children, labels[i-1])
+	}
+}
+
+// domain or any of its parent domains is in the trie
+func (t *SuffixTrie) Match(domain string) bool {
+	domain = lowerASCII(domain)
+	n := t.root
+	for end := len(domain); end >= 0; {
+		start := strings.LastIndexByte(domain[:end], '.') + 1
+		if n = n.children[domain[start:end]]; n == nil {
+			return false
+		}
+		if n.end {
+			return true
+		}
+		end = start - 1
+	}
+	return false
+}
+
+type acEdge struct {
+	c    byte
+	next int32
+}
+
+// aho-corasick automaton matching any of keywords in a string
+type KeywordMatcher struct {
+	edges [][]acEdge // sorted transitions of states
+	fail  []int32
+	out   []bool    // a keyword ends at the state or its suffixes
+	ids   [][]int32 // index of keywords end at the state
+	dict  []int32   // nearest state with ids in fail chain
+}
+
+func (m *KeywordMatcher) next(state int32, c byte) int32 {
+	edges := m.edges[state]
+	i := sort.Search(len(edges), func(i int) bool { return edges[i].c >= c })
+	if i < len(edges) && edges[i].c == c {
+		return edges[i].next
+	}
+	return -1
+}
+
+func (m *KeywordMatcher) addState() int32 {
+	m.edges = append(m.edges, nil)
+	m.fail = append(m.fail, 0)
+	m.out = append(m.out, false)
+	m.ids = append(m.ids, nil)
+	m.dict = append(m.dict, 0)
+	return int32(len(m.edges) - 1)
+}
+
+func NewKeywordMatcher(keywords []string) *KeywordMatcher {
+	type keyword struct {
+		val string
+		id  int32
+	}
+
+	// sorted keywords give sorted edges when building the trie
+	sorted := make([]keyword, 0, len(keywords))
+	for i, k := range keywords {
+		if k = strings.ToLower(k); len(k) > 0 {
+			sorted = append(sorted, keyword{k, int32(i)})
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].val < sorted[j].val })
+
+	m := new(KeywordMatcher)
+	m.addState()
+	for _, k := range sorted {
+		state := int32(0)
+		for i := 0; i < len(k.val); i++ {
+			next := m.next(state, k.val[i])
+			if next < 0 {
+				next = m.addState()
+				m.edges[state] = append(m.edges[state], acEdge{k.val[i], next})
+			}
+			state = next
+		}
+		m.out[state] = true
+		m.ids[state] = append(m.ids[state], k.id)
+	}
+
+	// fail links in bfs order
+	queue := make([]int32, 0, len(m.edges))
+	for _, e := range m.edges[0] {
+		queue = append(queue, e.next)
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for _, e := range m.edges[state] {
+			f := m.fail[state]
+			for f > 0 && m.next(f, e.c) < 0 {
+				f = m.fail[f]
+			}
+			if next := m.next(f, e.c); next >= 0 && next != e.next {
+				f = next
+			} else {
+				f = 0
+			}
+			m.fail[e.next] = f
+			m.out[e.next] = m.out[e.next] || m.out[f]
+			if len(m.ids[f]) > 0 {
+				m.dict[e.next] = f
+			} else {
+				m.dict[e.next] = m.dict[f]
+			}
+			queue = append(queue, e.next)
+		}
+	}
+	return m
+}
+
+func (m *KeywordMatcher) step(state int32, c byte) int32 {
+	if 'A' <= c && c <= 'Z' {
+		c += 'a' - 'A'
+	}
+	next := m.next(state, c)
+	for next < 0 && state > 0 {
+		state = m.fail[state]
+		next = m.next(state, c)
+	}
+	if next < 0 {
+		return 0
+	}
+	return next
+}
+
+// s contains any keyword, ignoring ascii case
+func (m *KeywordMatcher) Match(s string) bool {
+	state := int32(0)
+	for i := 0; i < len(s); i++ {
+		if state = m.step(state, s[i]); m.out[state] {
+			return true
+		}
+	}
+	return false
+}
+
+// call f with index of every keyword found in s, until f returns false
+func (m *KeywordMatcher) Each(s string, f func(id int) bool) {
+	state := int32(0)
+	for i := 0; i < len(s); i++ {
+		state = m.step(state, s[i])
+		for t := state; t > 0; t = m.dict[t] {
+			for _, id := range m.ids[t] {
+				if !f(int(id)) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// wildcards indexed by literal suffix after the last wildcard label,
+// eg: *.cdn-*.example.net -> example.net
+type WildcardSet struct {
+	index  map[string][]string
+	others []string // no literal suffix
+}
+
+func NewWildcardSet() *WildcardSet {
+	return &WildcardSet{index: make(map[string][]string)}
+}
+
+func wildcardSuffix(wildcard string) (string, bool) {
+	i := strings.LastIndexAny(wildcard, "*?")
+	if i < 0 {
+		return wildcard, true
+	}
+	j := strings.IndexByte(wildcard[i:], '.')
+	if j < 0 {
+		return "", false
+	}
+	return wildcard[i+j+1:], true
+}
+
+func (s *WildcardSet) Insert(wildcard string) {
+	wildcard = strings.ToLower(wildcard)
+	s.Remove(wildcard)
+	if suffix, ok := wildcardSuffix(wildcard); ok {
+		s.index[suffix] = append(s.index[suffix], wildcard)
+	} else {
+		s.others = append(s.others, wildcard)
+	}
+}
+
+func removeString(vals []string, val string) []string {
+	for i, v := range vals {
+		if v == val {
+			return append(vals[:i:i], vals[i+1:]...)
+		}
+	}
+	return vals
+}
+
+func (s *WildcardSet) Remove(wildcard string) {
+	wildcard = strings.ToLower(wildcard)
+	if suffix, ok := wildcardSuffix(wildcard); ok {
+		if wildcards := removeString(s.index[suffix], wildcard); len(wildcards) > 0 {
+			s.index[suffix] = wildcards
+		} else {
+			delete(s.index, suffix)
+		}
+	} else {
+		s.others = removeString(s.others, wildcard)
+	}
+}
+
+func (s *WildcardSet) Match(domain string) bool {
+	domain = lowerASCII(domain)
+	for suffix := domain; ; {
+		for _, wildcard := range s.index[suffix] {
+			if matchWildcard(wildcard, domain) {
+				return true
+			}
+		}
+		i := strings.IndexByte(suffix, '.')
+		if i < 0 {
+			break
+		}
+		suffix = suffix[i+1:]
+	}
+	for _, wildcard := range s.others {
+		if matchWildcard(wildcard, domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package k1
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestSuffixTrie(t *testing.T) {
+	trie := NewSuffixTrie()
+	trie.Insert("example.com")
+	trie.Insert("api.example.com")
+	trie.Insert("HK")
+
+	cases := map[string]bool{
+		"example.com":     true,
+		"www.Example.COM": true,
+		"1example.com":    false,
+		"com":             false,
+		"example.hk":      true,
+		"hk":              true,
+		"example.1hk":     false,
+		"":                false,
+	}
+	for domain, expected := range cases {
+		if trie.Match(domain) != expected {
+			t.Errorf("match %q, expected %v", domain, expected)
+		}
+	}
+
+	trie.Remove("example.com")
+	if trie.Match("www.example.com") || !trie.Match("api.example.com") {
+		t.Error("remove example.com failed")
+	}
+	trie.Remove("api.example.com")
+	if trie.root.children["com"] != nil {
+		t.Error("empty nodes should be pruned")
+	}
+}
+
+func randomLabel(r *rand.Rand, n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = "abcdefg-."[r.Intn(9)]
+	}
+	return string(b)
+}
+
+// compare with strings.Contains
+func TestKeywordMatcher(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	keywords := []string{"Example", "ample", "hk", "e.c"}
+	for i := 0; i < 200; i++ {
+		keywords = append(keywords, randomLabel(r, 3+r.Intn(4)))
+	}
+	m := NewKeywordMatcher(keywords)
+
+	for i := 0; i < 10000; i++ {
+		s := randomLabel(r, 1+r.Intn(20))
+		if i%3 == 0 {
+			s = strings.ToUpper(s)
+		}
+		expected := false
+		for _, k := range keywords {
+			if strings.Contains(strings.ToLower(s), strings.ToLower(k)) {
+				expected = true
+				break
+			}
+		}
+		if m.Match(s) != expected {
+			t.Fatalf("match %q, expected %v", s, expected)
+		}
+	}
+
+	// every occurrence of keywords
+	var found []string
+	NewKeywordMatcher([]string{"he", "she", "his", "hers"}).Each("ushers", func(id int) bool {
+		found = append(found, []string{"he", "she", "his", "hers"}[id])
+		return true
+	})
+	if strings.Join(found, ",") != "she,he,hers" {
+		t.Errorf("each found: %v", found)
+	}
+
+	if NewKeywordMatcher(nil).Match("example.com") {
+		t.Error("empty matcher should match nothing")
+	}
+}
+
+func benchmarkDomains(n int) []string {
+	r := rand.New(rand.NewSource(1))
+	domains := make([]string, n)
+	for i := range domains {
+		domains[i] = fmt.Sprintf("%s%d.%s", randomLabel(r, 8), i, []string{"com", "net", "org", "cn"}[i%4])
+	}
+	return domains
+}
+
+func BenchmarkDomainSuffixPattern(b *testing.B) {
+	domains := benchmarkDomains(100000)
+	pattern := NewDomainSuffixPattern("suffix", "", "A", domains)
+	queries := []string{"www." + domains[100], "api.cdn.Example.com", "a.b.c.d.e.f.example.net"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pattern.Match(queries[i%len(queries)])
+	}
+}
+
+func BenchmarkDomainKeywordPattern(b *testing.B) {
+	keywords := benchmarkDomains(100000)
+	for i := range keywords {
+		keywords[i] = keywords[i][:8]
+	}
+	pattern := NewDomainKeywordPattern("keyword", "", "A", keywords)
+	queries := []string{"www." + keywords[100] + ".com", "api.cdn.Example.com", "a.b.c.d.e.f.example.net"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pattern.Match(queries[i%len(queries)])
+	}
+}
@@ -0,0 +1,102 @@
+package k1
+
+import (
+	"fmt"
+	"strings"
+)
+
+// domains in fake ip filter always get real answer from backend dns
+type FakeIPFilter struct {
+	patterns  []Pattern
+	wildcards []string
+	created   map[string]Pattern // patterns of fake-ip-filter-pattern and their children
+}
+
+func (f *FakeIPFilter) Match(domain string) bool {
+	for _, pattern := range f.patterns {
+		if pattern.Match(domain) {
+			logger.Debugf("[dns] %s -> fake ip filter %s", domain, pattern.Name())
+			return true
+		}
+	}
+
+	domain = strings.ToLower(domain)
+	for _, wildcard := range f.wildcards {
+		if matchWildcard(wildcard, domain) {
+			logger.Debugf("[dns] %s -> fake ip filter %s", domain, wildcard)
+			return true
+		}
+	}
+	return false
+}
+
+// match domain against wildcard, `*` matches any characters in a label, `?` matches a character
+func matchWildcard(wildcard, domain string) bool {
+	for len(wildcard) > 0 {
+		switch wildcard[0] {
+		case '*':
+			// try every length of current label
+			for i := 0; i <= len(domain); i++ {
+				if matchWildcard(wildcard[1:], domain[i:]) {
+					return true
+				}
+				if i < len(domain) && domain[i] == '.' {
+					break
+				}
+			}
+			return false
+		case '?':
+			if len(domain) == 0 || domain[0] == '.' {
+				return false
+			}
+		default:
+			if len(domain) == 0 || domain[0] != wildcard[0] {
+				return false
+			}
+		}
+		wildcard = wildcard[1:]
+		domain = domain[1:]
+	}
+	return len(domain) == 0
+}
+
+// stop receiving values of providers
+func (f *FakeIPFilter) close() {
+	for _, pattern := range f.created {
+		if pp, ok := pattern.(*ProviderPattern); ok {
+			pp.close()
+		}
+	}
+}
+
+func checkFakeIPFilter(cfg DnsConfig, patterns map[string]*PatternConfig) error {
+	for _, name := range cfg.FakeIPFilterPattern {
+		if _, ok := patterns[name]; !ok {
+			return fmt.Errorf("[check dns] invalid fake-ip-filter-pattern: %q", name)
+		}
+	}
+	return nil
+}
+
+func NewFakeIPFilter(cfg DnsConfig, patterns map[string]*PatternConfig, providers *Providers) *FakeIPFilter {
+	f := new(FakeIPFilter)
+	if len(cfg.FakeIPFilterSuffix) > 0 {
+		f.patterns = append(f.patterns, NewDomainSuffixPattern("fake-ip-filter-suffix", DIRECT_POLICY, "", cfg.FakeIPFilterSuffix))
+	}
+	if len(cfg.FakeIPFilterKeyword) > 0 {
+		f.patterns = append(f.patterns, NewDomainKeywordPattern("fake-ip-filter-keyword", DIRECT_POLICY, "", cfg.FakeIPFilterKeyword))
+	}
+	for _, wildcard := range cfg.FakeIPFilterWildcard {
+		if len(wildcard) > 0 {
+			f.wildcards = append(f.wildcards, strings.ToLower(wildcard))
+		}
+	}
+	b := newPatternBuilder(patterns, providers)
+	for _, name := range cfg.FakeIPFilterPattern {
+		if pattern := b.create(name); pattern != nil {
+			f.patterns = append(f.patterns, pattern)
+		}
+	}
+	f.created = b.created
+	return f
+}
@@ -0,0 +1,58 @@
+package k1
+
+import (
+	"testing"
+)
+
+func TestFakeIPFilter(t *testing.T) {
+	filter := NewFakeIPFilter(DnsConfig{
+		FakeIPFilterSuffix:   []string{"lan"},
+		FakeIPFilterKeyword:  []string{"ntp"},
+		FakeIPFilterWildcard: []string{"stun.*.*", "time?.Apple.com"},
+		FakeIPFilterPattern:  []string{"direct"},
+	}, map[string]*PatternConfig{
+		"direct": {Scheme: schemeDomain, Policy: DIRECT_POLICY, V: []string{"example.com"}},
+	}, nil)
+
+	cases := map[string]bool{
+		"nas.lan":           true,
+		"pool.ntp.org":      true,
+		"stun.l.google.com": false,
+		"stun.qq.com":       true,
+		"time1.apple.com":   true,
+		"time.apple.com":    false,
+		"time12.apple.com":  false,
+		"example.com":       true,
+		"api.example.com":   false,
+		"www.google.com":    false,
+	}
+	for domain, expected := range cases {
+		if filter.Match(domain) != expected {
+			t.Errorf("match failed, domain: %s, expected: %v", domain, expected)
+		}
+	}
+}
+
+func TestReloadFakeIPFilter(t *testing.T) {
+	patterns := map[string]*PatternConfig{
+		"direct": {Scheme: schemeDomain, Policy: DIRECT_POLICY, V: []string{"example.com"}},
+	}
+	cfg := DnsConfig{FakeIPFilterPattern: []string{"direct"}}
+	d := new(Dns)
+	if d.matchFakeIPFilter("example.com") {
+		t.Fatal("no fake ip filter")
+	}
+	d.reloadFakeIPFilter(cfg, patterns, nil)
+	if !d.matchFakeIPFilter("example.com") {
+		t.Fatal("pattern should be matched")
+	}
+
+	// filter is built from patterns of the new config
+	patterns = map[string]*PatternConfig{
+		"direct": {Scheme: schemeDomain, Policy: DIRECT_POLICY, V: []string{"example.net"}},
+	}
+	d.reloadFakeIPFilter(cfg, patterns, nil)
+	if d.matchFakeIPFilter("example.com") || !d.matchFakeIPFilter("example.net") {
+		t.Error("reloaded pattern should be matched")
+	}
+}
@@ -0,0 +1,367 @@
+package k1
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// domain types of v2fly geosite.dat
+const (
+	geositePlain  = 0 // keyword
+	geositeRegex  = 1
+	geositeDomain = 2 // domain and its subdomains
+	geositeFull   = 3
+)
+
+var geositeDefaultFile = "mmdbs/geosite.dat"
+
+var errProtobuf = errors.New("invalid protobuf")
+
+type geositeEntry struct {
+	typ   uint64
+	value string
+	attrs []string
+}
+
+func (d *geositeEntry) hasAttr(attr string) bool {
+	for _, a := range d.attrs {
+		if a == attr {
+			return true
+		}
+	}
+	return false
+}
+
+// next field of protobuf message, val is the value of varint and
+// data is the bytes of length delimited field
+func protoNext(b []byte) (num int, val uint64, data []byte, rest []byte, err error) {
+	key, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, 0, nil, nil, errProtobuf
+	}
+	b = b[n:]
+	num = int(key >> 3)
+	switch key & 7 {
+	case 0: // varint
+		if val, n = binary.Uvarint(b); n <= 0 {
+			return 0, 0, nil, nil, errProtobuf
+		}
+		return num, val, nil, b[n:], nil
+	case 1: // 64 bits
+		if len(b) < 8 {
+			return 0, 0, nil, nil, errProtobuf
+		}
+		return num, binary.LittleEndian.Uint64(b), nil, b[8:], nil
+	case 2: // length delimited
+		size, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < size {
+			return 0, 0, nil, nil, errProtobuf
+		}
+		return num, 0, b[n : n+int(size)], b[n+int(size):], nil
+	case 5: // 32 bits
+		if len(b) < 4 {
+			return 0, 0, nil, nil, errProtobuf
+		}
+		return num, uint64(binary.LittleEndian.Uint32(b)), nil, b[4:], nil
+	}
+	return 0, 0, nil, nil, errProtobuf
+}
+
+func parseGeositeDomain(b []byte) (d geositeEntry, err error) {
+	for len(b) > 0 {
+		var num int
+		var val uint64
+		var data []byte
+		if num, val, data, b, err = protoNext(b); err != nil {
+			return
+		}
+		switch num {
+		case 1:
+			d.typ = val
+		case 2:
+			d.value = string(data)
+		case 3:
+			// attribute, only key is used
+			for attr := data; len(attr) > 0; {
+				var n int
+				var key []byte
+				if n, _, key, attr, err = protoNext(attr); err != nil {
+					return
+				}
+				if n == 1 {
+					d.attrs = append(d.attrs, strings.ToLower(string(key)))
+				}
+			}
+		}
+	}
+	return
+}
+
+// categories of geosite.dat, domains are decoded on demand
+type GeoSite struct {
+	lock       sync.Mutex
+	categories map[string][]byte // country code -> GeoSite message
+}
+
+func ParseGeoSite(b []byte) (*GeoSite, error) {
+	g := &GeoSite{categories: make(map[string][]byte)}
+	for len(b) > 0 {
+		num, _, site, rest, err := protoNext(b)
+		if err != nil {
+			return nil, err
+		}
+		b = rest
+		if num != 1 {
+			continue
+		}
+
+		for msg := site; len(msg) > 0; {
+			n, _, data, rest, err := protoNext(msg)
+			if err != nil {
+				return nil, err
+			}
+			msg = rest
+			if n == 1 {
+				g.categories[strings.ToLower(string(data))] = site
+				break
+			}
+		}
+	}
+	return g, nil
+}
+
+func (g *GeoSite) Categories() []string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	names := make([]string, 0, len(g.categories))
+	for name := range g.categories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// domains of category, eg: google, google@ads, cn@!cn
+func (g *GeoSite) Domains(val string) ([]geositeEntry, error) {
+	fields := strings.Split(strings.ToLower(strings.TrimSpace(val)), "@")
+	name, attrs := fields[0], fields[1:]
+
+	g.lock.Lock()
+	site, ok := g.categories[name]
+	g.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no geosite category: %s", name)
+	}
+
+	var domains []geositeEntry
+	for len(site) > 0 {
+		num, _, data, rest, err := protoNext(site)
+		if err != nil {
+			return nil, err
+		}
+		site = rest
+		if num != 2 {
+			continue
+		}
+		d, err := parseGeositeDomain(data)
+		if err != nil {
+			return nil, err
+		}
+		matched := true
+		for _, attr := range attrs {
+			if strings.HasPrefix(attr, "!") {
+				matched = matched && !d.hasAttr(attr[1:])
+			} else {
+				matched = matched && d.hasAttr(attr)
+			}
+		}
+		if matched {
+			domains = append(domains, d)
+		}
+	}
+	return domains, nil
+}
+
+// category name with optional attributes
+func isValidGeoSite(val string) bool {
+	for _, field := range strings.Split(val, "@") {
+		if field == "" || field == "!" {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	geoSiteLock sync.Mutex
+	geoSite     *GeoSite
+)
+
+func loadGeoSite(path string) (*GeoSite, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	g, err := ParseGeoSite(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	logger.Infof("[geosite] %d categories from %s", len(g.categories), path)
+	return g, nil
+}
+
+// load geosite.dat used by GEOSITE patterns
+func OpenGeoSite(path string) error {
+	g, err := loadGeoSite(path)
+	if err != nil {
+		return err
+	}
+	geoSiteLock.Lock()
+	geoSite = g
+	geoSiteLock.Unlock()
+	return nil
+}
+
+func currentGeoSite() *GeoSite {
+	geoSiteLock.Lock()
+	defer geoSiteLock.Unlock()
+	if geoSite == nil {
+		// default file is optional
+		if _, err := os.Stat(geositeDefaultFile); err == nil {
+			if geoSite, err = loadGeoSite(geositeDefaultFile); err != nil {
+				logger.Errorf("[geosite] %v", err)
+			}
+		}
+	}
+	return geoSite
+}
+
+// GEOSITE, domains of categories are matched by patterns of their types
+type GeoSitePattern struct {
+	name     string
+	policy   string
+	proxy    string
+	vals     map[string]bool
+	patterns []Pattern
+}
+
+func (p *GeoSitePattern) Name() string {
+	return p.name
+}
+
+func (p *GeoSitePattern) Policy() string {
+	return p.policy
+}
+
+func (p *GeoSitePattern) Proxy() string {
+	return p.proxy
+}
+
+func (p *GeoSitePattern) Match(val interface{}) bool {
+	if _, ok := val.(string); !ok {
+		return false
+	}
+	for _, pattern := range p.patterns {
+		if pattern.Match(val) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *GeoSitePattern) build() {
+	p.patterns = nil
+	g := currentGeoSite()
+	if g == nil {
+		if len(p.vals) > 0 {
+			logger.Errorf("[pattern] %s: no geosite file", p.name)
+		}
+		return
+	}
+
+	var full, suffix, keyword, regex []string
+	for val := range p.vals {
+		domains, err := g.Domains(val)
+		if err != nil {
+			logger.Errorf("[pattern] %s: %v", p.name, err)
+			continue
+		}
+		for _, d := range domains {
+			switch d.typ {
+			case geositeFull:
+				full = append(full, d.value)
+			case geositeDomain:
+				suffix = append(suffix, d.value)
+			case geositePlain:
+				keyword = append(keyword, d.value)
+			case geositeRegex:
+				regex = append(regex, d.value)
+			}
+		}
+	}
+	if len(full) > 0 {
+		p.patterns = append(p.patterns, NewDomainPattern(p.name, p.policy, p.proxy, full))
+	}
+	if len(suffix) > 0 {
+		p.patterns = append(p.patterns, NewDomainSuffixPattern(p.name, p.policy, p.proxy, suffix))
+	}
+	if len(keyword) > 0 {
+		p.patterns = append(p.patterns, NewDomainKeywordPattern(p.name, p.policy, p.proxy, keyword))
+	}
+	if len(regex) > 0 {
+		p.patterns = append(p.patterns, NewDomainRegexPattern(p.name, p.policy, p.proxy, regex))
+	}
+}
+
+func (p *GeoSitePattern) Add(val string) {
+	p.Update([]string{val}, nil)
+}
+
+func (p *GeoSitePattern) Remove(val string) {
+	p.Update(nil, []string{val})
+}
+
+// categories are decoded again on build, change them at once
+func (p *GeoSitePattern) Update(added, removed []string) {
+	for _, val := range added {
+		if len(val) > 0 {
+			p.vals[strings.ToLower(val)] = true
+		}
+	}
+	for _, val := range removed {
+		delete(p.vals, strings.ToLower(val))
+	}
+	p.build()
+}
+
+func (p *GeoSitePattern) Scheme() string {
+	return schemeGeoSite
+}
+
+func (p *GeoSitePattern) MarshalJSON() ([]byte, error) {
+	return jsoniter.Marshal(map[string]interface{}{
+		"name":   p.name,
+		"policy": p.policy,
+		"proxy":  p.proxy,
+		"vals":   p.vals,
+		"schema": p.Scheme(),
+	})
+}
+
+func NewGeoSitePattern(name, policy, proxy string, vals []string) Pattern {
+	p := new(GeoSitePattern)
+	p.name = name
+	p.policy = policy
+	p.proxy = proxy
+	p.vals = make(map[string]bool)
+	p.Update(vals, nil)
+	return p
+}
@@ -0,0 +1,188 @@
+package k1
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func appendUvarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+// protobuf length delimited field
+func protoBytes(num int, data []byte) []byte {
+	b := appendUvarint(nil, uint64(num<<3|2))
+	b = appendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func protoVarint(num int, val uint64) []byte {
+	b := appendUvarint(nil, uint64(num<<3))
+	return appendUvarint(b, val)
+}
+
+func testGeositeDomain(typ uint64, value string, attrs ...string) []byte {
+	b := protoVarint(1, typ)
+	b = append(b, protoBytes(2, []byte(value))...)
+	for _, attr := range attrs {
+		// key and bool value
+		a := append(protoBytes(1, []byte(attr)), protoVarint(2, 1)...)
+		b = append(b, protoBytes(3, a)...)
+	}
+	return b
+}
+
+func testGeositeData() []byte {
+	google := protoBytes(1, []byte("GOOGLE"))
+	google = append(google, protoBytes(2, testGeositeDomain(geositeDomain, "google.com"))...)
+	google = append(google, protoBytes(2, testGeositeDomain(geositeFull, "ads.google.com", "ads"))...)
+	google = append(google, protoBytes(2, testGeositeDomain(geositePlain, "googlevideo", "cn"))...)
+	google = append(google, protoBytes(2, testGeositeDomain(geositeRegex, `^ad\d+\.gstatic\.com$`, "ads"))...)
+
+	cn := protoBytes(1, []byte("CN"))
+	cn = append(cn, protoBytes(2, testGeositeDomain(geositeDomain, "baidu.com"))...)
+
+	return append(protoBytes(1, google), protoBytes(1, cn)...)
+}
+
+func TestGeoSitePattern(t *testing.T) {
+	g, err := ParseGeoSite(testGeositeData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := g.Categories(); len(names) != 2 || names[0] != "cn" || names[1] != "google" {
+		t.Fatalf("categories: %v", names)
+	}
+
+	geoSiteLock.Lock()
+	old := geoSite
+	geoSite = g
+	geoSiteLock.Unlock()
+	defer func() {
+		geoSiteLock.Lock()
+		geoSite = old
+		geoSiteLock.Unlock()
+	}()
+
+	cases := []struct {
+		vals    []string
+		matched map[string]bool
+	}{
+		{[]string{"google"}, map[string]bool{
+			"www.google.com":    true,
+			"ads.google.com":    true,
+			"r1.googlevideo.cn": true,
+			"ad12.gstatic.com":  true,
+			"www.baidu.com":     false,
+		}},
+		{[]string{"google@ads"}, map[string]bool{
+			"ads.google.com":     true,
+			"x.ads.google.com":   false,
+			"ad12.gstatic.com":   true,
+			"www.google.com":     false,
+			"r1.googlevideo.com": false,
+		}},
+		{[]string{"google@!ads", "CN"}, map[string]bool{
+			"www.google.com":     true,
+			"ads.google.com":     true, // subdomain of google.com
+			"ad12.gstatic.com":   false,
+			"r1.googlevideo.com": true,
+			"www.baidu.com":      true,
+		}},
+		{[]string{"google@ads@cn"}, map[string]bool{
+			"ads.google.com": false,
+		}},
+		{[]string{"unknown"}, map[string]bool{
+			"www.google.com": false,
+		}},
+	}
+	for _, c := range cases {
+		p := NewGeoSitePattern("geosite", REJECT_POLICY, "", c.vals)
+		for domain, expected := range c.matched {
+			if p.Match(domain) != expected {
+				t.Errorf("%v match %s, expected %v", c.vals, domain, expected)
+			}
+		}
+	}
+
+	p := NewGeoSitePattern("geosite", REJECT_POLICY, "", []string{"cn"})
+	p.Add("google@ads")
+	if !p.Match("ads.google.com") || !p.Match("baidu.com") {
+		t.Error("added category should be matched")
+	}
+	p.Remove("cn")
+	if p.Match("baidu.com") || p.Match(nil) {
+		t.Error("removed category should not be matched")
+	}
+	p.(*GeoSitePattern).Update([]string{"CN", "google"}, []string{"google@ads"})
+	if !p.Match("baidu.com") || !p.Match("www.google.com") {
+		t.Error("categories should be updated at once")
+	}
+}
+
+func TestOpenGeoSite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "geosite.dat")
+	if OpenGeoSite(path) == nil {
+		t.Fatal("missing file")
+	}
+	ioutil.WriteFile(path, []byte{0x0a, 0x10, 0x01}, 0644)
+	if OpenGeoSite(path) == nil {
+		t.Fatal("truncated file")
+	}
+
+	for val, expected := range map[string]bool{
+		"cn":         true,
+		"google@!cn": true,
+		"google@":    false,
+		"@ads":       false,
+		"cn@!":       false,
+	} {
+		if isValidGeoSite(val) != expected {
+			t.Errorf("valid geosite %q, expected %v", val, expected)
+		}
+	}
+}
+
+func TestGeoSiteDefaultFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	geoSiteLock.Lock()
+	old, oldFile := geoSite, geositeDefaultFile
+	geoSite, geositeDefaultFile = nil, filepath.Join(dir, "geosite.dat")
+	geoSiteLock.Unlock()
+	defer func() {
+		geoSiteLock.Lock()
+		geoSite, geositeDefaultFile = old, oldFile
+		geoSiteLock.Unlock()
+	}()
+	ioutil.WriteFile(geositeDefaultFile, testGeositeData(), 0644)
+
+	// loaded on the first pattern without geosite option
+	done := make(chan Pattern)
+	go func() {
+		done <- NewGeoSitePattern("geosite", REJECT_POLICY, "", []string{"cn"})
+	}()
+	select {
+	case p := <-done:
+		if !p.Match("www.baidu.com") {
+			t.Error("default file should be loaded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("loading default file is blocked")
+	}
+}
@@ -0,0 +1,251 @@
+package k1
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	hostsDefaultTtl    = 60
+	hostsMaxCnameDepth = 8
+)
+
+// static records of a host
+type HostEntry struct {
+	Name  string
+	IPv4  []net.IP
+	IPv6  []net.IP
+	CNAME string
+}
+
+func (e *HostEntry) add(value string) error {
+	if ip := net.ParseIP(value); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			e.IPv4 = append(e.IPv4, ip4)
+		} else {
+			e.IPv6 = append(e.IPv6, ip)
+		}
+		return nil
+	}
+
+	if _, ok := dns.IsDomainName(value); !ok {
+		return fmt.Errorf("invalid value: %s", value)
+	}
+	value = strings.ToLower(strings.TrimSuffix(value, "."))
+	if e.CNAME != "" && e.CNAME != value {
+		return fmt.Errorf("%s has multiple cname", e.Name)
+	}
+	e.CNAME = value
+	return nil
+}
+
+// static dns records from [hosts] and hosts files
+type Hosts struct {
+	ttl uint32
+
+	lock      sync.RWMutex // protect config, entries and wildcards
+	config    HostsConfig
+	entries   map[string]*HostEntry
+	wildcards []*HostEntry
+}
+
+func isWildcard(name string) bool {
+	return strings.ContainsAny(name, "*?")
+}
+
+func parseHostsLine(line string) []string {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	return strings.Fields(line)
+}
+
+type hostsParser struct {
+	entries map[string]*HostEntry
+	order   []*HostEntry
+}
+
+func (p *hostsParser) add(name, value string) error {
+	name = strings.ToLower(dns.Fqdn(name))
+	name = name[:len(name)-1]
+	entry := p.entries[name]
+	if entry == nil {
+		entry = &HostEntry{Name: name}
+		p.entries[name] = entry
+		p.order = append(p.order, entry)
+	}
+	// entry is kept unchanged on error, bad lines of files are skipped
+	next := *entry
+	if err := next.add(value); err != nil {
+		return err
+	}
+	if next.CNAME != "" && len(next.IPv4)+len(next.IPv6) > 0 {
+		return fmt.Errorf("%s has both cname and address", name)
+	}
+	*entry = next
+	return nil
+}
+
+// `ip name [name...]`, lines can't be parsed are logged and skipped,
+// eg: zone-scoped address fe80::1%lo0
+func (p *hostsParser) parseFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := parseHostsLine(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+			logger.Errorf("[hosts] %s:%d: invalid line, skipped", path, n)
+			continue
+		}
+		for _, name := range fields[1:] {
+			if err := p.add(name, fields[0]); err != nil {
+				logger.Errorf("[hosts] %s:%d: %v, skipped", path, n, err)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// `name value`, value is an ip or a cname
+func (p *hostsParser) parseStatic(val string) error {
+	fields := parseHostsLine(val)
+	if len(fields) != 2 {
+		return fmt.Errorf("invalid value: %s", val)
+	}
+	return p.add(fields[0], fields[1])
+}
+
+func parseHosts(static []string, files []string) (*hostsParser, error) {
+	p := &hostsParser{entries: make(map[string]*HostEntry)}
+	for _, val := range static {
+		if err := p.parseStatic(val); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range files {
+		if err := p.parseFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// [hosts] of config in use
+func (h *Hosts) Config() HostsConfig {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.config
+}
+
+// load [hosts] values and read hosts files again, ttl is kept
+func (h *Hosts) Reload(cfg HostsConfig) error {
+	p, err := parseHosts(cfg.V, cfg.File)
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[string]*HostEntry)
+	var wildcards []*HostEntry
+	for _, entry := range p.order {
+		if isWildcard(entry.Name) {
+			wildcards = append(wildcards, entry)
+		} else {
+			entries[entry.Name] = entry
+		}
+	}
+
+	h.lock.Lock()
+	h.config = cfg
+	h.entries = entries
+	h.wildcards = wildcards
+	h.lock.Unlock()
+	logger.Infof("[hosts] load %d entries, %d wildcards", len(entries), len(wildcards))
+	return nil
+}
+
+func (h *Hosts) Lookup(domain string) *HostEntry {
+	domain = strings.ToLower(domain)
+
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if entry := h.entries[domain]; entry != nil {
+		return entry
+	}
+	for _, entry := range h.wildcards {
+		if matchWildcard(entry.Name, domain) {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (h *Hosts) Entries() []*HostEntry {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	entries := make([]*HostEntry, 0, len(h.entries)+len(h.wildcards))
+	for _, entry := range h.entries {
+		entries = append(entries, entry)
+	}
+	return append(entries, h.wildcards...)
+}
+
+// answer request by entry, return cname to chase if any
+func (h *Hosts) Answer(r *dns.Msg, entry *HostEntry) (*dns.Msg, string) {
+	q := r.Question[0]
+	rsp := emptyAnswer(r)
+	rsp.Authoritative = true
+	hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: h.ttl}
+
+	if entry.CNAME != "" {
+		hdr.Rrtype = dns.TypeCNAME
+		rsp.Answer = append(rsp.Answer, &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(entry.CNAME)})
+		if q.Qtype == dns.TypeCNAME {
+			return rsp, ""
+		}
+		return rsp, entry.CNAME
+	}
+
+	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY {
+		hdr.Rrtype = dns.TypeA
+		for _, ip := range entry.IPv4 {
+			rsp.Answer = append(rsp.Answer, &dns.A{Hdr: hdr, A: ip})
+		}
+	}
+	if q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY {
+		hdr.Rrtype = dns.TypeAAAA
+		for _, ip := range entry.IPv6 {
+			rsp.Answer = append(rsp.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return rsp, ""
+}
+
+// bad lines of hosts files are skipped on load
+func checkHosts(cfg HostsConfig) error {
+	if _, err := parseHosts(cfg.V, nil); err != nil {
+		return fmt.Errorf("[check hosts] %v", err)
+	}
+	return nil
+}
+
+func NewHosts(cfg HostsConfig) (*Hosts, error) {
+	h := &Hosts{ttl: uint32(cfg.Ttl)}
+	if err := h.Reload(cfg); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
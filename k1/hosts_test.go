@@ -0,0 +1,105 @@
+package k1
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestHosts(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# comment\n192.168.1.10 nas.lan NAS2.lan # inline comment\n\n")
+	f.Close()
+
+	hosts, err := NewHosts(HostsConfig{
+		V: []string{
+			"nas.lan fd00::10",
+			"*.dev.lan 192.168.1.20",
+			"www.example.lan example.com.",
+		},
+		File: []string{f.Name()},
+		Ttl:  hostsDefaultTtl,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]int{
+		"nas.lan":         2,
+		"nas2.lan":        1,
+		"api.dev.lan":     1,
+		"a.api.dev.lan":   0,
+		"www.example.lan": 1,
+		"example.lan":     0,
+	}
+	for domain, answers := range cases {
+		entry := hosts.Lookup(domain)
+		if answers == 0 {
+			if entry != nil {
+				t.Errorf("%s should not match", domain)
+			}
+			continue
+		}
+		if entry == nil {
+			t.Errorf("%s should match", domain)
+			continue
+		}
+
+		r := new(dns.Msg)
+		r.SetQuestion(dns.Fqdn(domain), dns.TypeANY)
+		rsp, _ := hosts.Answer(r, entry)
+		if len(rsp.Answer) != answers {
+			t.Errorf("%s answers: %v", domain, rsp.Answer)
+		}
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.lan.", dns.TypeA)
+	if _, cname := hosts.Answer(r, hosts.Lookup("www.example.lan")); cname != "example.com" {
+		t.Errorf("cname: %s", cname)
+	}
+
+	if _, err := NewHosts(HostsConfig{V: []string{"a.lan 1.1.1.1", "a.lan b.lan"}}); err == nil {
+		t.Error("cname and address should conflict")
+	}
+}
+
+func TestHostsReload(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("fe80::1%lo0 localhost\n192.168.1.10 nas.lan\n192.168.1.11 www.example.lan\n")
+	f.Close()
+
+	// bad lines are skipped, entry is kept unchanged
+	cfg := HostsConfig{V: []string{"www.example.lan example.com"}, File: []string{f.Name()}}
+	hosts, err := NewHosts(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hosts.Lookup("nas.lan") == nil || hosts.Lookup("localhost") != nil {
+		t.Error("valid lines should be loaded")
+	}
+	if entry := hosts.Lookup("www.example.lan"); entry == nil || entry.CNAME != "example.com" || len(entry.IPv4) != 0 {
+		t.Errorf("conflict line should be skipped: %+v", entry)
+	}
+
+	// values of new config
+	if err := hosts.Reload(HostsConfig{V: []string{"router.lan 192.168.1.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if hosts.Lookup("router.lan") == nil || hosts.Lookup("nas.lan") != nil {
+		t.Error("hosts should be reloaded from new config")
+	}
+	if hosts.Reload(HostsConfig{V: []string{"bad"}}) == nil || hosts.Lookup("router.lan") == nil {
+		t.Error("invalid config should keep entries")
+	}
+}
@@ -1,6 +1,7 @@
 package k1
 
 import (
+	"fmt"
 	"github.com/gin-gonic/contrib/sessions"
 	"github.com/gin-gonic/gin"
 	"net/http"
@@ -234,6 +235,14 @@ func logout(c *gin.Context) {
 	//c.JSON(http.StatusOK, gin.H{"message": "Successfully logged out"})
 }
 
+// user of session, empty if not logged in
+func sessionUser(c *gin.Context) string {
+	if user := sessions.Default(c).Get(userkey); user != nil {
+		return fmt.Sprint(user)
+	}
+	return ""
+}
+
 func me(c *gin.Context) {
 	session := sessions.Default(c)
 	user := session.Get(userkey)
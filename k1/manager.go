@@ -8,10 +8,14 @@ import (
 	"github.com/miekg/dns"
 	"html/template"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// max entries shown on dns query log page
+const dnsLogPageSize = 500
+
 const masterTmpl = `
 {{define "header"}}
 <!DOCTYPE HTML>
@@ -158,13 +162,78 @@ table th.title {
 {{template "footer" .}}
 {{end}}
 
+{{define "dnslog"}}
+{{template "header" .}}
+<h2>{{.Title}}</h2>
+<form method="get">
+<input type="text" name="q" value="{{.Keyword}}" placeholder="client, domain, decision, proxy...">
+<input type="submit" value="Search">
+</form>
+<ul>
+<li>Entries: {{len .Records}}</li>
+</ul>
+<table>
+<tr>
+<th>Time</th>
+<th>Client</th>
+<th>Name</th>
+<th>Type</th>
+<th>Decision</th>
+<th>Proxy</th>
+<th>Upstream</th>
+<th>Rcode</th>
+<th>Latency</th>
+</tr>
+{{range .Records}}
+<tr>
+<td>{{.Time.Format "2006-01-02 15:04:05.000"}}</td>
+<td>{{.Client}}</td>
+<td>{{.Name}}</td>
+<td>{{.Type}}</td>
+<td>{{.Decision}}</td>
+<td>{{.Proxy}}</td>
+<td>{{.Upstream}}</td>
+<td>{{.Rcode}}</td>
+<td>{{.Latency}}</td>
+</tr>
+{{end}}
+</table>
+{{template "footer" .}}
+{{end}}
+
 {{define "dns"}}
 {{template "header" .}}
 <h2>Current State</h2>
 <ul>
 <li>Active entries: {{.ActiveEntries}}</li>
 <li>Expired entries:{{.ExpiredEntries}}</li>
+<li>Fake IP pool: {{.PoolUsed}} / {{.PoolCapacity}}</li>
+<li>Evicted entries: {{.PoolEvicted}}</li>
 </ul>
+<h2>Nameservers</h2>
+<table>
+<tr>
+<th>Nameserver</th>
+<th>Queries</th>
+<th>Errors</th>
+<th>Timeouts</th>
+<th>RTT</th>
+<th>Last Error</th>
+<th>Last Used</th>
+</tr>
+{{range .Upstreams}}
+<tr>
+<td>{{.Nameserver}}</td>
+<td>{{.Queries}}</td>
+<td>{{.Errors}}</td>
+<td>{{.Timeouts}}</td>
+<td>{{.Rtt}}</td>
+<td>{{.LastError}}</td>
+<td>{{.LastUsed.Format "2006-01-02 15:04:05.000"}}</td>
+</tr>
+{{end}}
+</table>
+<h2>Records</h2>
 <table>
 <tr>
 <th>Hostname</th>
@@ -185,6 +254,34 @@ table th.title {
 </table>
 {{template "footer" .}}
 {{end}}
+
+{{define "provider"}}
+{{template "header" .}}
+<h2>Rule Providers</h2>
+<table>
+<tr>
+<th>Name</th>
+<th>Url</th>
+<th>Format</th>
+<th>Entries</th>
+<th>Updated</th>
+<th>Checked</th>
+<th>Error</th>
+</tr>
+{{range .Providers}}
+<tr>
+<td>{{.Name}}</td>
+<td>{{.Url}}</td>
+<td>{{.Format}}</td>
+<td>{{.Count}}</td>
+<td>{{if not .Updated.IsZero}}{{.Updated.Format "2006-01-02 15:04:05"}}{{end}}</td>
+<td>{{if not .Checked.IsZero}}{{.Checked.Format "2006-01-02 15:04:05"}}{{end}}</td>
+<td>{{if .Error}}<span style="color:red">{{.Error}}</span>{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{template "footer" .}}
+{{end}}
 `
 
 // statistical data of every connection
@@ -254,6 +351,8 @@ func (m *Manager) indexHandle(w http.ResponseWriter, r *http.Request) error {
 			"/website/",
 			"/proxy/",
 			"/dns/",
+			"/dnslog/",
+			"/provider/",
 		},
 	})
 }
@@ -333,22 +432,48 @@ func (m *Manager) dnsHandle(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 
+	used, capacity, evicted := m.one.dnsTable.PoolStats()
+
 	return m.tmpl.ExecuteTemplate(w, "dns", map[string]interface{}{
 		"Title":          "dns cache",
 		"ActiveEntries":  activeEntries,
 		"ExpiredEntries": expiredEntires,
+		"PoolUsed":       used,
+		"PoolCapacity":   capacity,
+		"PoolEvicted":    evicted,
+		"Upstreams":      m.one.dns.UpstreamStats(),
 		"Now":            now,
 		"Records":        records,
 	})
 }
 
+func (m *Manager) providerHandle(w http.ResponseWriter, r *http.Request) error {
+	return m.tmpl.ExecuteTemplate(w, "provider", map[string]interface{}{
+		"Title":     "rule providers",
+		"Providers": m.one.providers.Status(),
+	})
+}
+
+func (m *Manager) dnsLogHandle(w http.ResponseWriter, r *http.Request) error {
+	keyword := r.URL.Query().Get("q")
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = dnsLogPageSize
+	}
+	return m.tmpl.ExecuteTemplate(w, "dnslog", map[string]interface{}{
+		"Title":   "dns query log",
+		"Keyword": keyword,
+		"Records": m.one.dns.queryLogs.Search(keyword, limit),
+	})
+}
+
 func (m *Manager) geoipHandle(c *gin.Context) {
 	host := c.Param("host")
 	msg := new(dns.Msg)
 	msg.Id = dns.Id()
 	msg.RecursionDesired = true
 	msg.Question = make([]dns.Question, 1)
-	msg.Question[0] = dns.Question{dns.Fqdn(host), dns.TypeA, dns.ClassINET}
+	msg.Question[0] = dns.Question{Name: dns.Fqdn(host), Qtype: dns.TypeA, Qclass: dns.ClassINET}
 
 	//for _,ns:=range m.one.dns.nameservers{
 	//m.one.dns.clients.Exchange(msg,ns)
@@ -360,13 +485,23 @@ func (m *Manager) geoipHandle(c *gin.Context) {
 		return
 	}
 
-	geores:=map[string]geoip.GeoLite2Country{}
+	type geoResult struct {
+		geoip.GeoLite2Country
+		ASN          uint   `json:"asn"`
+		Organization string `json:"organization"`
+	}
+	geores := map[string]geoResult{}
 
 	for _, item := range res.Answer {
 		switch answer := item.(type) {
 		case *dns.A:
 			//c.Writer.WriteString(fmt.Sprintf( "%s\n",answer))
-			geores[answer.A.String()]=geoip.QueryConuntryByIPDetails(answer.A)
+			asn := geoip.QueryASNByIPDetails(answer.A)
+			geores[answer.A.String()] = geoResult{
+				GeoLite2Country: geoip.QueryConuntryByIPDetails(answer.A),
+				ASN:             asn.AutonomousSystemNumber,
+				Organization:    asn.AutonomousSystemOrganization,
+			}
 
 		case *dns.CNAME:
 		default:
@@ -383,33 +518,92 @@ func (m *Manager) apiHandle(c *gin.Context) {
 				"ip2Domain":       m.one.dnsTable.ip2Domain,
 				"ipPool":          m.one.dnsTable.ipPool,
 				"nonProxyDomains": m.one.dnsTable.nonProxyDomains,
+				"upstreams":       m.one.dns.UpstreamStats(),
 			})
 			c.Writer.Write(bs)
 			return
 		}
-		bs, _ := jsoniter.Marshal(m.one.rule.patterns)
+		if dnslog := c.Query("dnslog"); dnslog != "" {
+			limit, _ := strconv.Atoi(c.Query("limit"))
+			bs, _ := jsoniter.Marshal(m.one.dns.queryLogs.Search(c.Query("q"), limit))
+			c.Writer.Write(bs)
+			return
+		}
+		if provider := c.Query("provider"); provider != "" {
+			bs, _ := jsoniter.Marshal(m.one.providers.Status())
+			c.Writer.Write(bs)
+			return
+		}
+		if overlay := c.Query("overlay"); overlay != "" {
+			bs, _ := jsoniter.Marshal(map[string]interface{}{
+				"edits":   m.one.rules.Load().Edits(),
+				"history": m.one.rules.History(),
+			})
+			c.Writer.Write(bs)
+			return
+		}
+		if diff := c.Query("diff"); diff != "" {
+			c.String(http.StatusOK, m.one.rules.Diff())
+			return
+		}
+		if hosts := c.Query("hosts"); hosts != "" {
+			bs, _ := jsoniter.Marshal(m.one.hosts.Entries())
+			c.Writer.Write(bs)
+			return
+		}
+		bs, _ := jsoniter.Marshal(m.one.rules.Load().patterns)
 		c.Writer.Write(bs)
 	}
 
+	if c.Request.Method == "POST" {
+		if name := c.Query("refresh"); name != "" {
+			provider := m.one.providers.Get(name)
+			if provider == nil {
+				c.String(http.StatusNotFound, "no provider: %s", name)
+				return
+			}
+			if err := provider.Refresh(); err != nil {
+				c.String(http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+		if name := c.Query("revert"); name != "" {
+			if err := m.one.rules.Revert(sessionUser(c), name, c.Query("val")); err != nil {
+				c.String(http.StatusNotFound, err.Error())
+			}
+			return
+		}
+		if c.Query("reload") != "" {
+			if err := m.one.Reload(); err != nil {
+				c.String(http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+	}
+
 	if c.Request.Method == "DELETE" {
 		name := c.Query("name")
 		val := c.Query("val")
+		if val == "" {
+			c.String(http.StatusBadRequest, "empty value")
+			return
+		}
 
-		for _, pattern := range m.one.rule.patterns {
-			if pattern.Name() == name {
-				pattern.Remove(val)
-			}
+		if err := m.one.rules.Edit(sessionUser(c), name, val, false); err != nil {
+			c.String(http.StatusNotFound, err.Error())
 		}
 	}
 
 	if c.Request.Method == "PUT" {
 		name := c.Query("name")
 		val := c.Query("val")
+		if val == "" {
+			c.String(http.StatusBadRequest, "empty value")
+			return
+		}
 
-		for _, pattern := range m.one.rule.patterns {
-			if pattern.Name() == name {
-				pattern.Add(val)
-			}
+		if err := m.one.rules.Edit(sessionUser(c), name, val, true); err != nil {
+			c.String(http.StatusNotFound, err.Error())
 		}
 	}
 
@@ -471,6 +665,8 @@ func (m *Manager) Serve() error {
 		rg.GET("/website/", gin.WrapF(handleWrapper(m.websiteHandle)))
 		rg.GET("/proxy/", gin.WrapF(handleWrapper(m.proxyHandle)))
 		rg.GET("/dns/", gin.WrapF(handleWrapper(m.dnsHandle)))
+		rg.GET("/dnslog/", gin.WrapF(handleWrapper(m.dnsLogHandle)))
+		rg.GET("/provider/", gin.WrapF(handleWrapper(m.providerHandle)))
 		rg.GET("/host/:host", gin.WrapF(handleWrapper(m.hostHandle)))
 		rg.GET("/website/:site", gin.WrapF(handleWrapper(m.websiteHandle)))
 		rg.GET("/proxy/:proxy", gin.WrapF(handleWrapper(m.proxyHandle)))
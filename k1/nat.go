@@ -2,6 +2,7 @@ package k1
 
 import (
 	"net"
+	"sync"
 	"time"
 )
 
@@ -74,26 +75,83 @@ type NatSession struct {
 	srcPort   uint16
 	dstPort   uint16
 	lastTouch int64
+
+	processOnce sync.Once
+	process     *Process
 }
 
 type Nat struct {
+	lock     sync.Mutex // protect tbl, sessions and lastCheck, sessions are looked up by dns server too
 	tbl      *NatTable
 	sessions []*NatSession
 
 	checkThreshold int
 	lastCheck      int64
+
+	// last touch of sessions to a destination ip, read by dns table
+	active     map[activeKey]int64
+	activeLock sync.Mutex
+}
+
+// ipv4 and ipv6 destination in 16 bytes, no allocation per packet
+type activeKey [net.IPv6len]byte
+
+func newActiveKey(ip net.IP) (key activeKey) {
+	ip = ip.To16()
+	for i := 0; i < len(ip) && i < len(key); i++ {
+		key[i] = ip[i]
+	}
+	return key
+}
+
+func (nat *Nat) touchActive(ip net.IP, now int64) {
+	nat.activeLock.Lock()
+	nat.active[newActiveKey(ip)] = now
+	nat.activeLock.Unlock()
+}
+
+// refresh session once a second, other packets in the second skip activeLock. called with lock held
+func (nat *Nat) touch(session *NatSession, now int64) {
+	if session.lastTouch != now {
+		session.lastTouch = now
+		nat.touchActive(session.dstIP, now)
+	}
+}
+
+// any session to ip is alive
+func (nat *Nat) IsActive(ip net.IP) bool {
+	nat.activeLock.Lock()
+	defer nat.activeLock.Unlock()
+	touch, ok := nat.active[newActiveKey(ip)]
+	return ok && time.Now().Unix()-touch < NatSessionLifeSeconds
 }
 
 func (nat *Nat) getSession(port uint16) *NatSession {
+	nat.lock.Lock()
+	defer nat.lock.Unlock()
 	session := nat.sessions[port-nat.tbl.from]
 	if session != nil {
-		session.lastTouch = time.Now().Unix()
+		nat.touch(session, time.Now().Unix())
 	}
 
 	return session
 }
 
+// session of mapped address, nil if not found
+func (nat *Nat) lookupSession(ip net.IP, port uint16) *NatSession {
+	if port < nat.tbl.from || port >= nat.tbl.to {
+		return nil
+	}
+	session := nat.getSession(port)
+	if session == nil || !session.dstIP.Equal(ip) {
+		return nil
+	}
+	return session
+}
+
 func (nat *Nat) allocSession(srcIP, dstIP net.IP, srcPort, dstPort uint16) (bool, uint16) {
+	nat.lock.Lock()
+	defer nat.lock.Unlock()
 	now := time.Now().Unix()
 	nat.clearExpiredSessions(now)
 
@@ -108,20 +166,32 @@ func (nat *Nat) allocSession(srcIP, dstIP net.IP, srcPort, dstPort uint16) (bool
 			lastTouch: now,
 		}
 		nat.sessions[port-tbl.from] = session
+		nat.touchActive(dstIP, now)
+	} else if port != 0 {
+		nat.touch(nat.sessions[port-tbl.from], now)
 	}
 	return isNew, port
 }
 
+// called with lock held
 func (nat *Nat) clearExpiredSessions(now int64) {
 	if now-nat.lastCheck < NatSessionCheckInterval {
 		return
 	}
+	nat.lastCheck = now
 
-	if nat.count() < nat.checkThreshold {
+	nat.activeLock.Lock()
+	for ip, touch := range nat.active {
+		if now-touch >= NatSessionLifeSeconds {
+			delete(nat.active, ip)
+		}
+	}
+	nat.activeLock.Unlock()
+
+	if nat.tbl.Count() < nat.checkThreshold {
 		return
 	}
 
-	nat.lastCheck = now
 	for index, session := range nat.sessions {
 		if session != nil && now-session.lastTouch >= NatSessionLifeSeconds {
 			nat.sessions[index] = nil
@@ -131,6 +201,8 @@ func (nat *Nat) clearExpiredSessions(now int64) {
 }
 
 func (nat *Nat) count() int {
+	nat.lock.Lock()
+	defer nat.lock.Unlock()
 	return nat.tbl.Count()
 }
 
@@ -150,5 +222,6 @@ func NewNat(from, to uint16) *Nat {
 		tbl:            tbl,
 		sessions:       make([]*NatSession, count),
 		checkThreshold: int(count) / 10,
+		active:         make(map[activeKey]int64),
 	}
 }
@@ -73,3 +73,74 @@ func BenchmarkNat(b *testing.B) {
 		b.Error("release session failed")
 	}
 }
+
+func TestNatLookupSession(t *testing.T) {
+	nat := NewNat(10, 20)
+
+	srcIP := net.ParseIP("192.168.1.2")
+	dstIP := net.ParseIP("8.8.8.8")
+	_, port := nat.allocSession(srcIP, dstIP, 5353, 53)
+
+	if session := nat.lookupSession(dstIP, port); session == nil || !session.srcIP.Equal(srcIP) {
+		t.Error("lookup session failed")
+	}
+
+	if nat.lookupSession(srcIP, port) != nil {
+		t.Error("lookup session with another ip should fail")
+	}
+
+	if nat.lookupSession(dstIP, 53) != nil {
+		t.Error("lookup session out of range should fail")
+	}
+}
+
+func TestNatActive(t *testing.T) {
+	nat := NewNat(10, 20)
+	dstIP := net.ParseIP("198.18.0.1")
+
+	_, port := nat.allocSession(net.ParseIP("192.168.1.2").To4(), dstIP.To4(), 12345, 443)
+	if !nat.IsActive(dstIP) || !nat.IsActive(dstIP.To4()) || nat.IsActive(net.ParseIP("198.18.0.2")) {
+		t.Fatal("destination of session should be active")
+	}
+
+	// touched again in a later second
+	session := nat.getSession(port)
+	session.lastTouch -= NatSessionLifeSeconds
+	nat.active[newActiveKey(dstIP)] = session.lastTouch
+	if nat.IsActive(dstIP) {
+		t.Fatal("expired destination should not be active")
+	}
+	nat.getSession(port)
+	if !nat.IsActive(dstIP) {
+		t.Error("destination should be active after touch")
+	}
+}
+
+// run with -race, dns server looks up sessions while tun allocates them
+func TestNatConcurrentLookup(t *testing.T) {
+	nat := NewNat(10, 20)
+	dstIP := net.ParseIP("8.8.8.8").To4()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			nat.allocSession(net.ParseIP("192.168.1.2").To4(), dstIP, uint16(40000+i%20), 53)
+			nat.lock.Lock()
+			nat.clearExpiredSessions(time.Now().Unix() + int64(i%2)*NatSessionLifeSeconds)
+			nat.lock.Unlock()
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		for port := uint16(10); port < 20; port++ {
+			if session := nat.lookupSession(dstIP, port); session != nil && session.dstPort != 53 {
+				t.Fatalf("session: %+v", session)
+			}
+		}
+	}
+}
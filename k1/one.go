@@ -1,8 +1,13 @@
 package k1
 
 import (
+	"fmt"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/nxsre/kone/geoip"
 	. "github.com/nxsre/kone/internal"
 	"github.com/nxsre/kone/tcpip"
 )
@@ -16,9 +21,12 @@ type One struct {
 	// tun virtual network
 	subnet *net.IPNet
 
-	rule     *Rule
-	dnsTable *DnsTable
-	proxies  *Proxies
+	rules     *RuleSet
+	file      string // config file
+	providers *Providers
+	dnsTable  *DnsTable
+	hosts     *Hosts
+	proxies   *Proxies
 
 	dns      *Dns
 	tcpRelay *TCPRelay
@@ -41,10 +49,64 @@ func (one *One) Serve() error {
 	go runAndWait(one.tcpRelay.Serve)
 	go runAndWait(one.udpRelay.Serve)
 	go runAndWait(one.tun.Serve)
+	go runAndWait(one.providers.Serve)
 	if one.manager != nil {
 		go runAndWait(one.manager.Serve)
 	}
-	return <-done
+
+	go runAndWait(func() error {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+		for sig := range sigCh {
+			if sig == syscall.SIGHUP {
+				one.Reload()
+				continue
+			}
+			return fmt.Errorf("receive signal: %v", sig)
+		}
+		return nil
+	})
+
+	err := <-done
+	if saveErr := one.dnsTable.Save(); saveErr != nil {
+		logger.Errorf("[dns] save cache file failed: %v", saveErr)
+	}
+	return err
+}
+
+// reload [hosts], [pattern], [rule] and fake ip filter of config file,
+// nothing is changed if the new config is invalid
+func (one *One) Reload() error {
+	if one.file == "" {
+		return one.reloadHosts(one.hosts.Config())
+	}
+
+	cfg, err := ParseConfig(one.file)
+	if err != nil {
+		logger.Errorf("[rule] reload failed: %v", err)
+		return err
+	}
+	if err := one.reloadHosts(cfg.Hosts); err != nil {
+		return err
+	}
+	for name, pattern := range cfg.Pattern {
+		for _, provider := range pattern.Provider {
+			if one.providers.Get(provider) == nil {
+				logger.Errorf("[rule] pattern %q: new provider %q is loaded on restart", name, provider)
+			}
+		}
+	}
+	one.rules.Reload(cfg.Rule, cfg.Pattern)
+	one.dns.reloadFakeIPFilter(cfg.Dns, cfg.Pattern, one.providers)
+	return nil
+}
+
+func (one *One) reloadHosts(cfg HostsConfig) error {
+	if err := one.hosts.Reload(cfg); err != nil {
+		logger.Errorf("[hosts] reload failed: %v", err)
+		return err
+	}
+	return nil
 }
 
 func FromConfig(cfg *KoneConfig) (*One, error) {
@@ -56,28 +118,55 @@ func FromConfig(cfg *KoneConfig) (*One, error) {
 	one := &One{
 		ip:     ip.To4(),
 		subnet: subnet,
+		file:   cfg.file,
+	}
+
+	if general.AsnDb != "" {
+		if err := geoip.OpenASNDB(general.AsnDb); err != nil {
+			return nil, fmt.Errorf("[geoip] open asn db failed: %v", err)
+		}
+	}
+
+	if general.GeoSite != "" {
+		if err := OpenGeoSite(general.GeoSite); err != nil {
+			return nil, fmt.Errorf("[geosite] open failed: %v", err)
+		}
 	}
 
+	// rule providers, refreshed in background
+	one.providers = NewProviders(cfg.Provider)
+
 	// new rule
-	one.rule = NewRule(cfg.Rule, cfg.Pattern)
+	one.rules = NewRuleSet(cfg.Rule, cfg.Pattern, one.providers)
 
 	// new dns cache
-	one.dnsTable = NewDnsTable(ip, subnet)
+	one.dnsTable = NewDnsTable(ip, subnet, cfg.Dns)
 
 	var err error
 
+	// new hosts
+	if one.hosts, err = NewHosts(cfg.Hosts); err != nil {
+		return nil, err
+	}
+
 	// new dns
-	if one.dns, err = NewDns(one, cfg.Dns); err != nil {
+	if one.dns, err = NewDns(one, cfg.Dns, one.hosts, cfg.Pattern); err != nil {
 		return nil, err
 	}
 
 	if one.proxies, err = NewProxies(one, cfg.Proxy); err != nil {
 		return nil, err
 	}
+	one.providers.proxies = one.proxies
 
 	one.tcpRelay = NewTCPRelay(one, cfg.TCP)
 	one.udpRelay = NewUDPRelay(one, cfg.UDP)
 
+	// keep fake ip of active connections
+	one.dnsTable.inUse = func(ip net.IP) bool {
+		return one.tcpRelay.nat.IsActive(ip) || one.udpRelay.nat.IsActive(ip)
+	}
+
 	filters := map[tcpip.IPProtocol]PacketFilter{
 		tcpip.ICMP: PacketFilterFunc(icmpFilterFunc),
 		tcpip.TCP:  one.tcpRelay,
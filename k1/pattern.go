@@ -1,23 +1,71 @@
 package k1
 
 import (
+	"fmt"
 	jsoniter "github.com/json-iterator/go"
 	"net"
+	"regexp"
+	"regexp/syntax"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/nxsre/kone/geoip"
-	"github.com/nxsre/kone/tcpip"
 )
 
 const (
-	schemeDomain        = "DOMAIN"
-	schemeDomainSuffix  = "DOMAIN-SUFFIX"
-	schemeDomainKeyword = "DOMAIN-KEYWORD"
-	schemeIPCountry     = "IP-COUNTRY"
-	schemeIPCIDR        = "IP-CIDR"
+	schemeDomain         = "DOMAIN"
+	schemeDomainSuffix   = "DOMAIN-SUFFIX"
+	schemeDomainKeyword  = "DOMAIN-KEYWORD"
+	schemeIPCountry      = "IP-COUNTRY"
+	schemeIPCIDR         = "IP-CIDR"
+	schemeDomainWildcard = "DOMAIN-WILDCARD"
+	schemeDomainRegex    = "DOMAIN-REGEX"
+	schemeDstPort        = "DST-PORT"
+	schemeNetwork        = "NETWORK"
+	schemeSrcIPCIDR      = "SRC-IP-CIDR"
+	schemeIPASN          = "IP-ASN"
+	schemeGeoSite        = "GEOSITE"
+	schemeProcessName    = "PROCESS-NAME"
+	schemeProcessPath    = "PROCESS-PATH"
+	schemeUID            = "UID"
+	schemeAnd            = "AND"
+	schemeOr             = "OR"
+	schemeNot            = "NOT"
 )
 
+// patterns matching *Flow, evaluated at connection time
+func isFlowScheme(scheme string) bool {
+	switch scheme {
+	case schemeDstPort, schemeNetwork, schemeSrcIPCIDR, schemeProcessName, schemeProcessPath, schemeUID:
+		return true
+	}
+	return false
+}
+
+// patterns matching domain strings
+func isDomainScheme(scheme string) bool {
+	switch scheme {
+	case schemeDomain, schemeDomainSuffix, schemeDomainKeyword, schemeDomainWildcard, schemeDomainRegex, schemeGeoSite:
+		return true
+	}
+	return false
+}
+
+// patterns matching net.IP or ipv4 in uint32
+func isIPScheme(scheme string) bool {
+	switch scheme {
+	case schemeIPCIDR, schemeIPCountry, schemeIPASN:
+		return true
+	}
+	return false
+}
+
+// patterns matching client of *Flow, evaluated at dns query time too
+func isSourceScheme(scheme string) bool {
+	return scheme == schemeSrcIPCIDR
+}
+
 type Pattern interface {
 	Name() string
 	Scheme() string
@@ -111,6 +159,7 @@ type DomainSuffixPattern struct {
 	policy string
 	proxy  string
 	vals   map[string]bool
+	trie   *SuffixTrie
 }
 
 func (p *DomainSuffixPattern) Name() string {
@@ -131,25 +180,14 @@ func (p *DomainSuffixPattern) Match(val interface{}) bool {
 		return false
 	}
 
-	v = strings.ToLower(v)
-	for {
-		if p.vals[v] {
-			return true
-		}
-
-		pos := strings.Index(v, ".")
-		if pos < 0 {
-			break
-		}
-		v = v[pos+1:]
-	}
-	return false
+	return p.trie.Match(v)
 }
 
 func (p *DomainSuffixPattern) Add(val string) {
 	if len(val) > 0 { // ignore empty suffix
 		val = strings.ToLower(val)
 		p.vals[val] = true
+		p.trie.Insert(val)
 	}
 }
 
@@ -157,6 +195,7 @@ func (p *DomainSuffixPattern) Remove(val string) {
 	if len(val) > 0 { // ignore empty suffix
 		val = strings.ToLower(val)
 		delete(p.vals, val)
+		p.trie.Remove(val)
 	}
 }
 
@@ -180,6 +219,7 @@ func NewDomainSuffixPattern(name, policy, proxy string, vals []string) Pattern {
 	p.policy = policy
 	p.proxy = proxy
 	p.vals = make(map[string]bool)
+	p.trie = NewSuffixTrie()
 	for _, val := range vals {
 		p.Add(val)
 	}
@@ -188,10 +228,11 @@ func NewDomainSuffixPattern(name, policy, proxy string, vals []string) Pattern {
 
 // DOMAIN-KEYWORD
 type DomainKeywordPattern struct {
-	name   string
-	policy string
-	proxy  string
-	vals   map[string]bool
+	name    string
+	policy  string
+	proxy   string
+	vals    map[string]bool
+	matcher *KeywordMatcher // rebuilt on change
 }
 
 func (p *DomainKeywordPattern) Name() string {
@@ -211,19 +252,22 @@ func (p *DomainKeywordPattern) Match(val interface{}) bool {
 	if !ok {
 		return false
 	}
-	v = strings.ToLower(v)
+	return p.matcher.Match(v)
+}
+
+func (p *DomainKeywordPattern) build() {
+	keywords := make([]string, 0, len(p.vals))
 	for k := range p.vals {
-		if strings.Index(v, k) >= 0 {
-			return true
-		}
+		keywords = append(keywords, k)
 	}
-	return false
+	p.matcher = NewKeywordMatcher(keywords)
 }
 
 func (p *DomainKeywordPattern) Add(val string) {
 	if len(val) > 0 { // ignore empty suffix
 		val = strings.ToLower(val)
 		p.vals[val] = true
+		p.build()
 	}
 }
 
@@ -231,6 +275,7 @@ func (p *DomainKeywordPattern) Remove(val string) {
 	if len(val) > 0 { // ignore empty suffix
 		val = strings.ToLower(val)
 		delete(p.vals, val)
+		p.build()
 	}
 }
 
@@ -255,8 +300,11 @@ func NewDomainKeywordPattern(name, policy, proxy string, vals []string) Pattern
 	p.proxy = proxy
 	p.vals = make(map[string]bool)
 	for _, val := range vals {
-		p.Add(val)
+		if len(val) > 0 { // ignore empty keyword
+			p.vals[strings.ToLower(val)] = true
+		}
 	}
+	p.build()
 	return p
 }
 
@@ -335,43 +383,91 @@ func NewIPCountryPattern(name, policy, proxy string, vals []string) Pattern {
 	return p
 }
 
-// IPRangeArray
-type IPRange struct {
-	Start uint32
-	End   uint32
+// `AS13335` or `13335`
+func parseASN(val string) (uint, error) {
+	val = strings.TrimSpace(val)
+	if len(val) > 2 && strings.EqualFold(val[:2], "AS") {
+		val = val[2:]
+	}
+	asn, err := strconv.ParseUint(val, 10, 32)
+	if err != nil || asn == 0 {
+		return 0, fmt.Errorf("invalid asn: %s", val)
+	}
+	return uint(asn), nil
 }
 
-func (p *IPRange) MarshalJSON() ([]byte, error) {
-	return jsoniter.Marshal(map[string]interface{}{
-		"start": tcpip.ConvertUint32ToIPv4(p.Start),
-		"end":   tcpip.ConvertUint32ToIPv4(p.End),
-	})
+// IP-ASN
+type IPASNPattern struct {
+	name   string
+	policy string
+	proxy  string
+	vals   map[uint]bool
+}
+
+func (p *IPASNPattern) Name() string {
+	return p.name
+}
+
+func (p *IPASNPattern) Policy() string {
+	return p.policy
 }
 
-type IPRangeArray []IPRange
+func (p *IPASNPattern) Proxy() string {
+	return p.proxy
+}
 
-func (a IPRangeArray) Len() int           { return len(a) }
-func (a IPRangeArray) Less(i, j int) bool { return a[i].End < a[j].End }
-func (a IPRangeArray) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (p *IPASNPattern) Match(val interface{}) bool {
+	var asn uint
+	switch ip := val.(type) {
+	case uint32:
+		asn = geoip.QueryASNByIP(net.IPv4(byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip)))
+	case net.IP:
+		asn = geoip.QueryASNByIP(ip)
+	}
+	return asn != 0 && p.vals[asn]
+}
 
-func (a IPRangeArray) Contains(ip uint32) bool {
-	l := len(a)
-	i := sort.Search(l, func(i int) bool {
-		n := a[i]
-		return n.End >= ip
-	})
+func (p *IPASNPattern) Add(val string) {
+	if asn, err := parseASN(val); err == nil {
+		p.vals[asn] = true
+	}
+}
 
-	if i < l {
-		n := a[i]
-		if n.Start <= ip {
-			return true
-		}
+func (p *IPASNPattern) Remove(val string) {
+	if asn, err := parseASN(val); err == nil {
+		delete(p.vals, asn)
 	}
-	return false
 }
 
-func (a IPRangeArray) ContainsIP(ip net.IP) bool {
-	return a.Contains(tcpip.ConvertIPv4ToUint32(ip))
+func (p *IPASNPattern) Scheme() string {
+	return schemeIPASN
+}
+
+func (p *IPASNPattern) MarshalJSON() ([]byte, error) {
+	vals := make([]string, 0, len(p.vals))
+	for asn := range p.vals {
+		vals = append(vals, fmt.Sprintf("AS%d", asn))
+	}
+	sort.Strings(vals)
+	return jsoniter.Marshal(map[string]interface{}{
+		"name":   p.name,
+		"policy": p.policy,
+		"proxy":  p.proxy,
+		"vals":   vals,
+		"schema": p.Scheme(),
+	})
+}
+
+func NewIPASNPattern(name, policy, proxy string, vals []string) Pattern {
+	p := new(IPASNPattern)
+	p.name = name
+	p.policy = policy
+	p.proxy = proxy
+	p.vals = make(map[uint]bool)
+	for _, val := range vals {
+		p.Add(val)
+	}
+	return p
 }
 
 // IP-CIDR
@@ -379,7 +475,7 @@ type IPCIDRPattern struct {
 	name   string
 	policy string
 	proxy  string
-	vals   IPRangeArray
+	vals   *CIDRTrie
 }
 
 func (p *IPCIDRPattern) Name() string {
@@ -397,9 +493,9 @@ func (p *IPCIDRPattern) Proxy() string {
 func (p *IPCIDRPattern) Match(val interface{}) bool {
 	switch ip := val.(type) {
 	case uint32:
-		return p.vals.Contains(ip)
+		return p.vals.ContainsUint32(ip)
 	case net.IP:
-		return p.vals.ContainsIP(ip)
+		return p.vals.Contains(ip)
 	}
 
 	return false
@@ -408,16 +504,7 @@ func (p *IPCIDRPattern) Match(val interface{}) bool {
 func (p *IPCIDRPattern) Add(val string) {
 	if len(val) > 0 { // ignore empty suffix
 		if _, ipNet, err := net.ParseCIDR(val); err == nil {
-			start := tcpip.ConvertIPv4ToUint32(ipNet.IP)
-			_end := start + ^tcpip.ConvertIPv4ToUint32(net.IP(ipNet.Mask))
-			// 判断是否已存在，不能重复添加记录
-			if p.vals.Contains(start+1) || p.vals.Contains(_end-1) {
-				return
-			}
-			p.vals = append(p.vals, IPRange{
-				Start: start,
-				End:   _end,
-			})
+			p.vals.Insert(ipNet)
 		}
 	}
 }
@@ -425,13 +512,7 @@ func (p *IPCIDRPattern) Add(val string) {
 func (p *IPCIDRPattern) Remove(val string) {
 	if len(val) > 0 { // ignore empty suffix
 		if _, ipNet, err := net.ParseCIDR(val); err == nil {
-			start := tcpip.ConvertIPv4ToUint32(ipNet.IP)
-			_end := start + ^tcpip.ConvertIPv4ToUint32(net.IP(ipNet.Mask))
-			for k, v := range p.vals {
-				if v.Start == start && v.End == _end {
-					p.vals = append(p.vals[:k], p.vals[k+1:]...)
-				}
-			}
+			p.vals.Remove(ipNet)
 		}
 	}
 }
@@ -455,11 +536,493 @@ func NewIPCIDRPattern(name, policy, proxy string, vals []string) Pattern {
 	p.name = name
 	p.policy = policy
 	p.proxy = proxy
+	p.vals = new(CIDRTrie)
 	for _, val := range vals {
 		p.Add(val)
 	}
+	return p
+}
+
+// SRC-IP-CIDR
+type SrcIPCIDRPattern struct {
+	name   string
+	policy string
+	proxy  string
+	vals   *CIDRTrie
+}
+
+func (p *SrcIPCIDRPattern) Name() string {
+	return p.name
+}
 
-	sort.Sort(p.vals)
+func (p *SrcIPCIDRPattern) Policy() string {
+	return p.policy
+}
+
+func (p *SrcIPCIDRPattern) Proxy() string {
+	return p.proxy
+}
+
+func (p *SrcIPCIDRPattern) Match(val interface{}) bool {
+	flow, ok := val.(*Flow)
+	if !ok || flow.SrcIP == nil {
+		return false
+	}
+	return p.vals.Contains(flow.SrcIP)
+}
+
+func (p *SrcIPCIDRPattern) Add(val string) {
+	if _, ipNet, err := net.ParseCIDR(val); err == nil {
+		p.vals.Insert(ipNet)
+	}
+}
+
+func (p *SrcIPCIDRPattern) Remove(val string) {
+	if _, ipNet, err := net.ParseCIDR(val); err == nil {
+		p.vals.Remove(ipNet)
+	}
+}
+
+func (p *SrcIPCIDRPattern) Scheme() string {
+	return schemeSrcIPCIDR
+}
+
+func (p *SrcIPCIDRPattern) MarshalJSON() ([]byte, error) {
+	return jsoniter.Marshal(map[string]interface{}{
+		"name":   p.name,
+		"policy": p.policy,
+		"proxy":  p.proxy,
+		"vals":   p.vals,
+		"schema": p.Scheme(),
+	})
+}
+
+func NewSrcIPCIDRPattern(name, policy, proxy string, vals []string) Pattern {
+	p := new(SrcIPCIDRPattern)
+	p.name = name
+	p.policy = policy
+	p.proxy = proxy
+	p.vals = new(CIDRTrie)
+	for _, val := range vals {
+		p.Add(val)
+	}
+	return p
+}
+
+// DOMAIN-WILDCARD
+type DomainWildcardPattern struct {
+	name   string
+	policy string
+	proxy  string
+	vals   map[string]bool
+	set    *WildcardSet
+}
+
+func (p *DomainWildcardPattern) Name() string {
+	return p.name
+}
+
+func (p *DomainWildcardPattern) Policy() string {
+	return p.policy
+}
+
+func (p *DomainWildcardPattern) Proxy() string {
+	return p.proxy
+}
+
+func (p *DomainWildcardPattern) Match(val interface{}) bool {
+	v, ok := val.(string)
+	if !ok {
+		return false
+	}
+	return p.set.Match(v)
+}
+
+func (p *DomainWildcardPattern) Add(val string) {
+	if len(val) > 0 { // ignore empty wildcard
+		val = strings.ToLower(val)
+		p.vals[val] = true
+		p.set.Insert(val)
+	}
+}
+
+func (p *DomainWildcardPattern) Remove(val string) {
+	if len(val) > 0 { // ignore empty wildcard
+		val = strings.ToLower(val)
+		delete(p.vals, val)
+		p.set.Remove(val)
+	}
+}
+
+func (p *DomainWildcardPattern) Scheme() string {
+	return schemeDomainWildcard
+}
+
+func (p *DomainWildcardPattern) MarshalJSON() ([]byte, error) {
+	return jsoniter.Marshal(map[string]interface{}{
+		"name":   p.name,
+		"policy": p.policy,
+		"proxy":  p.proxy,
+		"vals":   p.vals,
+		"schema": p.Scheme(),
+	})
+}
+
+// `*` matches any characters in a label, `?` matches a character
+func isValidDomainWildcard(val string) bool {
+	if len(val) == 0 || strings.HasPrefix(val, ".") || strings.HasSuffix(val, ".") || strings.Contains(val, "..") {
+		return false
+	}
+	for _, c := range strings.ToLower(val) {
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.ContainsRune("-_.*?", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func NewDomainWildcardPattern(name, policy, proxy string, vals []string) Pattern {
+	p := new(DomainWildcardPattern)
+	p.name = name
+	p.policy = policy
+	p.proxy = proxy
+	p.vals = make(map[string]bool)
+	p.set = NewWildcardSet()
+	for _, val := range vals {
+		p.Add(val)
+	}
+	return p
+}
+
+// DOMAIN-REGEX
+type DomainRegexPattern struct {
+	name   string
+	policy string
+	proxy  string
+	vals   map[string]bool
+
+	// rebuilt on change, only regexes whose required literal is found are run
+	exprs    []*regexp.Regexp
+	literals *KeywordMatcher // required literal -> index of exprs
+	index    []int
+	always   []int // exprs without required literal
+}
+
+func (p *DomainRegexPattern) Name() string {
+	return p.name
+}
+
+func (p *DomainRegexPattern) Policy() string {
+	return p.policy
+}
+
+func (p *DomainRegexPattern) Proxy() string {
+	return p.proxy
+}
+
+func (p *DomainRegexPattern) Match(val interface{}) bool {
+	v, ok := val.(string)
+	if !ok {
+		return false
+	}
+	v = lowerASCII(v)
+	for _, i := range p.always {
+		if p.exprs[i].MatchString(v) {
+			return true
+		}
+	}
+	matched := false
+	p.literals.Each(v, func(id int) bool {
+		matched = p.exprs[p.index[id]].MatchString(v)
+		return !matched
+	})
+	return matched
+}
+
+// domains are lowercased before matching, so literals like `^API\.` must fold case
+func compileDomainRegex(val string) (*regexp.Regexp, error) {
+	return regexp.Compile("(?i)" + val)
+}
+
+// longest literal every match must contain, empty if none
+func requiredLiteral(re *syntax.Regexp) string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return strings.ToLower(string(re.Rune))
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiteral(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return requiredLiteral(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		longest := ""
+		for _, sub := range re.Sub {
+			if literal := requiredLiteral(sub); len(literal) > len(longest) {
+				longest = literal
+			}
+		}
+		return longest
+	}
+	return ""
+}
+
+func (p *DomainRegexPattern) build() {
+	vals := make([]string, 0, len(p.vals))
+	for val := range p.vals {
+		vals = append(vals, val)
+	}
+	sort.Strings(vals)
+
+	var exprs []*regexp.Regexp
+	var literals []string
+	var index, always []int
+	for _, val := range vals {
+		re, err := compileDomainRegex(val)
+		if err != nil {
+			continue
+		}
+		exprs = append(exprs, re)
+
+		literal := ""
+		if tree, err := syntax.Parse(val, syntax.Perl); err == nil {
+			literal = requiredLiteral(tree.Simplify())
+		}
+		if literal == "" {
+			always = append(always, len(exprs)-1)
+		} else {
+			literals = append(literals, literal)
+			index = append(index, len(exprs)-1)
+		}
+	}
+	p.exprs, p.index, p.always = exprs, index, always
+	p.literals = NewKeywordMatcher(literals)
+}
+
+func (p *DomainRegexPattern) Add(val string) {
+	if len(val) > 0 { // ignore empty regex
+		if _, err := compileDomainRegex(val); err != nil {
+			logger.Errorf("[pattern] %s invalid regex %q: %v", p.name, val, err)
+			return
+		}
+		p.vals[val] = true
+		p.build()
+	}
+}
+
+func (p *DomainRegexPattern) Remove(val string) {
+	if len(val) > 0 { // ignore empty regex
+		delete(p.vals, val)
+		p.build()
+	}
+}
+
+func (p *DomainRegexPattern) Scheme() string {
+	return schemeDomainRegex
+}
+
+func (p *DomainRegexPattern) MarshalJSON() ([]byte, error) {
+	return jsoniter.Marshal(map[string]interface{}{
+		"name":   p.name,
+		"policy": p.policy,
+		"proxy":  p.proxy,
+		"vals":   p.vals,
+		"schema": p.Scheme(),
+	})
+}
+
+func NewDomainRegexPattern(name, policy, proxy string, vals []string) Pattern {
+	p := new(DomainRegexPattern)
+	p.name = name
+	p.policy = policy
+	p.proxy = proxy
+	p.vals = make(map[string]bool)
+	for _, val := range vals {
+		if len(val) > 0 { // ignore empty regex
+			p.vals[val] = true
+		}
+	}
+	p.build()
+	return p
+}
+
+type portRange struct {
+	from uint16
+	to   uint16
+}
+
+// `port` or `from-to`
+func parsePortRange(val string) (portRange, error) {
+	fields := strings.SplitN(strings.TrimSpace(val), "-", 2)
+	from, err := strconv.ParseUint(strings.TrimSpace(fields[0]), 10, 16)
+	if err != nil {
+		return portRange{}, err
+	}
+	to := from
+	if len(fields) == 2 {
+		if to, err = strconv.ParseUint(strings.TrimSpace(fields[1]), 10, 16); err != nil {
+			return portRange{}, err
+		}
+	}
+	if from > to {
+		return portRange{}, fmt.Errorf("invalid port range: %s", val)
+	}
+	return portRange{uint16(from), uint16(to)}, nil
+}
+
+// DST-PORT
+type DstPortPattern struct {
+	name   string
+	policy string
+	proxy  string
+	vals   map[string]bool
+	ranges []portRange
+}
+
+func (p *DstPortPattern) Name() string {
+	return p.name
+}
+
+func (p *DstPortPattern) Policy() string {
+	return p.policy
+}
+
+func (p *DstPortPattern) Proxy() string {
+	return p.proxy
+}
+
+func (p *DstPortPattern) Match(val interface{}) bool {
+	flow, ok := val.(*Flow)
+	if !ok {
+		return false
+	}
+	for _, r := range p.ranges {
+		if r.from <= flow.DstPort && flow.DstPort <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *DstPortPattern) build() {
+	p.ranges = p.ranges[:0:0]
+	for val := range p.vals {
+		if r, err := parsePortRange(val); err == nil {
+			p.ranges = append(p.ranges, r)
+		}
+	}
+}
+
+func (p *DstPortPattern) Add(val string) {
+	if _, err := parsePortRange(val); err == nil {
+		p.vals[strings.TrimSpace(val)] = true
+		p.build()
+	}
+}
+
+func (p *DstPortPattern) Remove(val string) {
+	delete(p.vals, strings.TrimSpace(val))
+	p.build()
+}
+
+func (p *DstPortPattern) Scheme() string {
+	return schemeDstPort
+}
+
+func (p *DstPortPattern) MarshalJSON() ([]byte, error) {
+	return jsoniter.Marshal(map[string]interface{}{
+		"name":   p.name,
+		"policy": p.policy,
+		"proxy":  p.proxy,
+		"vals":   p.vals,
+		"schema": p.Scheme(),
+	})
+}
+
+func NewDstPortPattern(name, policy, proxy string, vals []string) Pattern {
+	p := new(DstPortPattern)
+	p.name = name
+	p.policy = policy
+	p.proxy = proxy
+	p.vals = make(map[string]bool)
+	for _, val := range vals {
+		if _, err := parsePortRange(val); err == nil {
+			p.vals[strings.TrimSpace(val)] = true
+		}
+	}
+	p.build()
+	return p
+}
+
+// NETWORK
+type NetworkPattern struct {
+	name   string
+	policy string
+	proxy  string
+	vals   map[string]bool
+}
+
+func isValidNetwork(val string) bool {
+	switch strings.ToLower(val) {
+	case "tcp", "udp":
+		return true
+	}
+	return false
+}
+
+func (p *NetworkPattern) Name() string {
+	return p.name
+}
+
+func (p *NetworkPattern) Policy() string {
+	return p.policy
+}
+
+func (p *NetworkPattern) Proxy() string {
+	return p.proxy
+}
+
+func (p *NetworkPattern) Match(val interface{}) bool {
+	flow, ok := val.(*Flow)
+	if !ok {
+		return false
+	}
+	return p.vals[flow.Network]
+}
+
+func (p *NetworkPattern) Add(val string) {
+	if isValidNetwork(val) {
+		p.vals[strings.ToLower(val)] = true
+	}
+}
+
+func (p *NetworkPattern) Remove(val string) {
+	delete(p.vals, strings.ToLower(val))
+}
+
+func (p *NetworkPattern) Scheme() string {
+	return schemeNetwork
+}
+
+func (p *NetworkPattern) MarshalJSON() ([]byte, error) {
+	return jsoniter.Marshal(map[string]interface{}{
+		"name":   p.name,
+		"policy": p.policy,
+		"proxy":  p.proxy,
+		"vals":   p.vals,
+		"schema": p.Scheme(),
+	})
+}
+
+func NewNetworkPattern(name, policy, proxy string, vals []string) Pattern {
+	p := new(NetworkPattern)
+	p.name = name
+	p.policy = policy
+	p.proxy = proxy
+	p.vals = make(map[string]bool)
+	for _, val := range vals {
+		p.Add(val)
+	}
 	return p
 }
 
@@ -472,6 +1035,19 @@ func init() {
 	patternSchemes[schemeDomainKeyword] = NewDomainKeywordPattern
 	patternSchemes[schemeIPCountry] = NewIPCountryPattern
 	patternSchemes[schemeIPCIDR] = NewIPCIDRPattern
+	patternSchemes[schemeDomainWildcard] = NewDomainWildcardPattern
+	patternSchemes[schemeDomainRegex] = NewDomainRegexPattern
+	patternSchemes[schemeDstPort] = NewDstPortPattern
+	patternSchemes[schemeNetwork] = NewNetworkPattern
+	patternSchemes[schemeSrcIPCIDR] = NewSrcIPCIDRPattern
+	patternSchemes[schemeIPASN] = NewIPASNPattern
+	patternSchemes[schemeGeoSite] = NewGeoSitePattern
+	patternSchemes[schemeProcessName] = NewProcessNamePattern
+	patternSchemes[schemeProcessPath] = NewProcessPathPattern
+	patternSchemes[schemeUID] = NewUIDPattern
+	patternSchemes[schemeAnd] = NewAndPattern
+	patternSchemes[schemeOr] = NewOrPattern
+	patternSchemes[schemeNot] = NewNotPattern
 }
 
 func IsExistPatternScheme(scheme string) bool {
@@ -0,0 +1,160 @@
+package k1
+
+import (
+	"net"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// AND, OR and NOT of named patterns, eg: google AND udp.
+// children are resolved when building rule, see NewRule
+type LogicalPattern struct {
+	name     string
+	policy   string
+	proxy    string
+	scheme   string
+	names    []string
+	patterns []Pattern
+	flow     bool // has flow level children, only matches *Flow
+}
+
+func isLogicalScheme(scheme string) bool {
+	switch scheme {
+	case schemeAnd, schemeOr, schemeNot:
+		return true
+	}
+	return false
+}
+
+// pattern matches *Flow, evaluated at connection time
+func isFlowPattern(p Pattern) bool {
+	if lp, ok := p.(*LogicalPattern); ok {
+		return lp.flow
+	}
+	return isFlowScheme(p.Scheme())
+}
+
+func (p *LogicalPattern) Name() string {
+	return p.name
+}
+
+func (p *LogicalPattern) Policy() string {
+	return p.policy
+}
+
+func (p *LogicalPattern) Proxy() string {
+	return p.proxy
+}
+
+func (p *LogicalPattern) addChild(child Pattern) {
+	p.patterns = append(p.patterns, child)
+	p.flow = p.flow || isFlowPattern(child)
+}
+
+// child matches flow by its host or ip if it isn't a flow level pattern
+func matchChild(child Pattern, val interface{}) bool {
+	flow, ok := val.(*Flow)
+	if !ok || isFlowPattern(child) {
+		return child.Match(val)
+	}
+	return flow.Host != "" && child.Match(flow.Host) || flow.DstIP != nil && child.Match(flow.DstIP)
+}
+
+// pattern decides on values of the kind of val, others never match it
+func handlesValue(p Pattern, val interface{}) bool {
+	if lp, ok := p.(*LogicalPattern); ok {
+		for _, child := range lp.patterns {
+			if handlesValue(child, val) {
+				return true
+			}
+		}
+		return false
+	}
+	switch val.(type) {
+	case *Flow:
+		return isFlowScheme(p.Scheme())
+	case string:
+		return isDomainScheme(p.Scheme())
+	case net.IP, uint32:
+		return isIPScheme(p.Scheme())
+	}
+	return false
+}
+
+func (p *LogicalPattern) Match(val interface{}) bool {
+	if _, ok := val.(*Flow); ok != p.flow {
+		return false
+	}
+
+	switch p.scheme {
+	case schemeAnd:
+		for _, child := range p.patterns {
+			if !matchChild(child, val) {
+				return false
+			}
+		}
+		return len(p.patterns) > 0
+	case schemeOr:
+		for _, child := range p.patterns {
+			if matchChild(child, val) {
+				return true
+			}
+		}
+	case schemeNot:
+		// children match flow by its host or ip, plain values of other kinds are never matched
+		handled := p.flow
+		for _, child := range p.patterns {
+			if matchChild(child, val) {
+				return false
+			}
+			handled = handled || handlesValue(child, val)
+		}
+		return handled
+	}
+	return false
+}
+
+// children are fixed at config load
+func (p *LogicalPattern) Add(val string) {
+	logger.Errorf("[pattern] %s: can't add %q to %s pattern", p.name, val, p.scheme)
+}
+
+func (p *LogicalPattern) Remove(val string) {
+	logger.Errorf("[pattern] %s: can't remove %q from %s pattern", p.name, val, p.scheme)
+}
+
+func (p *LogicalPattern) Scheme() string {
+	return p.scheme
+}
+
+func (p *LogicalPattern) MarshalJSON() ([]byte, error) {
+	return jsoniter.Marshal(map[string]interface{}{
+		"name":   p.name,
+		"policy": p.policy,
+		"proxy":  p.proxy,
+		"vals":   p.names,
+		"schema": p.Scheme(),
+	})
+}
+
+func newLogicalPattern(scheme, name, policy, proxy string, vals []string) *LogicalPattern {
+	p := new(LogicalPattern)
+	p.name = name
+	p.policy = policy
+	p.proxy = proxy
+	p.scheme = scheme
+	p.names = append(p.names, vals...)
+	return p
+}
+
+func NewAndPattern(name, policy, proxy string, vals []string) Pattern {
+	return newLogicalPattern(schemeAnd, name, policy, proxy, vals)
+}
+
+func NewOrPattern(name, policy, proxy string, vals []string) Pattern {
+	return newLogicalPattern(schemeOr, name, policy, proxy, vals)
+}
+
+func NewNotPattern(name, policy, proxy string, vals []string) Pattern {
+	return newLogicalPattern(schemeNot, name, policy, proxy, vals)
+}
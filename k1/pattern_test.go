@@ -1,6 +1,7 @@
 package k1
 
 import (
+	"fmt"
 	"net"
 	"testing"
 
@@ -90,6 +91,23 @@ func TestIPCountryPattern(t *testing.T) {
 	checkCases(t, proxy, pattern, cases)
 }
 
+func TestIPASNPattern(t *testing.T) {
+	for val, expected := range map[string]uint{"AS13335": 13335, "as15169": 15169, " 4134 ": 4134, "AS": 0, "0": 0, "AS1x": 0} {
+		if asn, _ := parseASN(val); asn != expected {
+			t.Errorf("parse %q: %d, expected %d", val, asn, expected)
+		}
+	}
+
+	pattern := NewIPASNPattern("ip-asn", "", "D", []string{"AS13335", "x"}).(*IPASNPattern)
+	if len(pattern.vals) != 1 || !pattern.vals[13335] {
+		t.Fatalf("vals: %v", pattern.vals)
+	}
+	pattern.Remove("13335")
+	if len(pattern.vals) != 0 {
+		t.Fatalf("vals: %v", pattern.vals)
+	}
+}
+
 func TestIPCIDRPattern(t *testing.T) {
 	proxy := "D"
 	pattern := NewIPCIDRPattern("ip-cidr", "", proxy, []string{
@@ -112,3 +130,262 @@ func TestIPCIDRPattern(t *testing.T) {
 	}
 	checkCases(t, proxy, pattern, cases)
 }
+
+func TestDomainWildcardPattern(t *testing.T) {
+	proxy := "E"
+	pattern := NewDomainWildcardPattern("domain-wildcard", "", proxy, []string{
+		"*.cdn-*.example.net",
+		"ad?.example.com",
+		"*.lan",
+	})
+
+	cases := map[interface{}]bool{
+		"img.cdn-01.example.net":   true,
+		"IMG.CDN-01.example.net":   true,
+		"a.img.cdn-01.example.net": false,
+		"img.cdn.example.net":      false,
+		"ad1.example.com":          true,
+		"ad12.example.com":         false,
+		"nas.lan":                  true,
+		"lan":                      false,
+	}
+	checkCases(t, proxy, pattern, cases)
+
+	pattern.Remove("*.lan")
+	pattern.Add("nas*")
+	checkCases(t, proxy, pattern, map[interface{}]bool{
+		"nas.lan": false,
+		"nas1":    true,
+	})
+}
+
+func TestDomainRegexPattern(t *testing.T) {
+	proxy := "F"
+	pattern := NewDomainRegexPattern("domain-regex", "", proxy, []string{
+		`^ad[0-9]+\.`,
+		`\.example\.(com|net)$`,
+		`^[0-9]+\.(lan|home)$`, // no required literal
+		`(?i)TRACKER`,
+		`^API\.`, // matched case-insensitively
+	})
+
+	cases := map[interface{}]bool{
+		"123.home":         true,
+		"123.homes":        false,
+		"a.tracker.io":     true,
+		"ad1.example.org":  true,
+		"AD12.example.org": true,
+		"api.example.org":  true,
+		"API.example.org":  true,
+		"apix.example.org": false,
+		"bad1.example.org": false,
+		"www.example.com":  true,
+		"www.example.cn":   false,
+	}
+	checkCases(t, proxy, pattern, cases)
+
+	pattern.Remove(`^ad[0-9]+\.`)
+	pattern.Add(`(`) // invalid regex is ignored
+	checkCases(t, proxy, pattern, map[interface{}]bool{
+		"ad1.example.org": false,
+		"www.example.net": true,
+	})
+}
+
+func TestDstPortPattern(t *testing.T) {
+	proxy := "G"
+	pattern := NewDstPortPattern("dst-port", "", proxy, []string{"22", "8000-9000", "9-1", "x"})
+
+	cases := map[interface{}]bool{
+		&Flow{DstPort: 22}:   true,
+		&Flow{DstPort: 23}:   false,
+		&Flow{DstPort: 8000}: true,
+		&Flow{DstPort: 9000}: true,
+		&Flow{DstPort: 9001}: false,
+		&Flow{DstPort: 5}:    false,
+		"22":                 false,
+	}
+	checkCases(t, proxy, pattern, cases)
+
+	pattern.Remove("8000-9000")
+	pattern.Add("443")
+	checkCases(t, proxy, pattern, map[interface{}]bool{
+		&Flow{DstPort: 8080}: false,
+		&Flow{DstPort: 443}:  true,
+	})
+}
+
+func TestNetworkPattern(t *testing.T) {
+	proxy := "H"
+	pattern := NewNetworkPattern("network", "", proxy, []string{"UDP", "icmp"})
+
+	cases := map[interface{}]bool{
+		&Flow{Network: "udp"}: true,
+		&Flow{Network: "tcp"}: false,
+		"udp":                 false,
+	}
+	checkCases(t, proxy, pattern, cases)
+}
+
+func TestSrcIPCIDRPattern(t *testing.T) {
+	proxy := "I"
+	pattern := NewSrcIPCIDRPattern("src-ip-cidr", "", proxy, []string{"192.168.1.0/28", "fd00::/8"})
+
+	cases := map[interface{}]bool{
+		&Flow{SrcIP: net.ParseIP("192.168.1.2")}:  true,
+		&Flow{SrcIP: net.ParseIP("192.168.1.16")}: false,
+		&Flow{SrcIP: net.ParseIP("fd00::1")}:      true,
+		&Flow{DstIP: net.ParseIP("192.168.1.2")}:  false,
+		"192.168.1.2":                             false,
+	}
+	checkCases(t, proxy, pattern, cases)
+}
+
+func TestRuleSource(t *testing.T) {
+	patterns := map[string]*PatternConfig{
+		"tv":      {Policy: PROXY_POLICY, Proxy: "T", Scheme: schemeSrcIPCIDR, V: []string{"192.168.1.10/32"}},
+		"example": {Policy: DIRECT_POLICY, Scheme: schemeDomainSuffix, V: []string{"example.com"}},
+		"kids":    {Policy: REJECT_POLICY, Scheme: schemeSrcIPCIDR, V: []string{"192.168.2.0/24"}},
+	}
+	rule := NewRule(RuleConfig{Pattern: []string{"example", "tv", "kids"}, Final: "B"}, patterns, nil)
+
+	tv, kid, other := net.ParseIP("192.168.1.10"), net.ParseIP("192.168.2.3"), net.ParseIP("192.168.1.2")
+	if p := rule.SourcePattern(tv, "www.google.com"); p == nil || p.Proxy() != "T" {
+		t.Errorf("source pattern of tv: %v", p)
+	}
+	// domain pattern ahead of source pattern
+	if p := rule.SourcePattern(tv, "www.example.com"); p != nil {
+		t.Errorf("source pattern of tv for example.com: %v", p.Name())
+	}
+	if rule.SourcePattern(other, "www.google.com") != nil || rule.SourcePattern(nil, "www.google.com") != nil {
+		t.Error("source pattern of other client")
+	}
+	if !rule.RejectFrom(kid, "www.example.com") || rule.RejectFrom(other, "www.google.com") {
+		t.Error("reject by source failed")
+	}
+
+	proxy, reject := rule.ProxyFlow(&Flow{Network: "tcp", SrcIP: tv, Host: "www.google.com", DstPort: 443}, "B")
+	if proxy != "T" || reject {
+		t.Errorf("flow of tv: %q %v", proxy, reject)
+	}
+	if _, reject = rule.ProxyFlow(&Flow{Network: "tcp", SrcIP: kid, DstIP: net.ParseIP("1.2.3.4"), DstPort: 443}, "B"); !reject {
+		t.Error("flow of kid should be rejected")
+	}
+}
+
+func TestRuleProxyFlow(t *testing.T) {
+	patterns := map[string]*PatternConfig{
+		"ssh":     {Policy: PROXY_POLICY, Proxy: "S", Scheme: schemeDstPort, V: []string{"22"}},
+		"example": {Policy: PROXY_POLICY, Proxy: "A", Scheme: schemeDomainSuffix, V: []string{"example.com"}},
+		"quic":    {Policy: REJECT_POLICY, Scheme: schemeNetwork, V: []string{"udp"}},
+	}
+	rule := NewRule(RuleConfig{Pattern: []string{"ssh", "example", "quic"}, Final: "B"}, patterns, nil)
+
+	cases := []struct {
+		flow   *Flow
+		proxy  string
+		reject bool
+	}{
+		{&Flow{Network: "tcp", Host: "www.example.com", DstPort: 22}, "S", false},
+		{&Flow{Network: "tcp", Host: "www.example.com", DstPort: 443}, "A", false},
+		// patterns after the one matching host are not checked
+		{&Flow{Network: "udp", Host: "www.example.com", DstPort: 443}, "A", false},
+		{&Flow{Network: "udp", Host: "www.example.org", DstPort: 443}, "", true},
+		{&Flow{Network: "tcp", DstIP: net.ParseIP("1.2.3.4"), DstPort: 80}, "B", false},
+	}
+	for _, c := range cases {
+		_, proxy := rule.Proxy(c.flow.Host)
+		if c.flow.Host == "" {
+			_, proxy = rule.Proxy(c.flow.DstIP)
+		}
+		proxy, reject := rule.ProxyFlow(c.flow, proxy)
+		if proxy != c.proxy || reject != c.reject {
+			t.Errorf("%v: proxy %q reject %v, expected %q %v", c.flow, proxy, reject, c.proxy, c.reject)
+		}
+	}
+}
+
+func TestLogicalPattern(t *testing.T) {
+	patterns := map[string]*PatternConfig{
+		"google":     {Scheme: schemeDomainSuffix, V: []string{"google.com"}},
+		"udp":        {Scheme: schemeNetwork, V: []string{"udp"}},
+		"lan":        {Scheme: schemeIPCIDR, V: []string{"192.168.0.0/16"}},
+		"quic":       {Policy: REJECT_POLICY, Scheme: schemeAnd, V: []string{"google", "udp"}},
+		"not-google": {Policy: PROXY_POLICY, Proxy: "A", Scheme: schemeNot, V: []string{"google"}},
+		"either":     {Policy: PROXY_POLICY, Proxy: "B", Scheme: schemeOr, V: []string{"lan", "not-google"}},
+	}
+	if err := checkLogicalPatterns(patterns); err != nil {
+		t.Fatal(err)
+	}
+	rule := NewRule(RuleConfig{Pattern: []string{"quic", "either"}}, patterns, nil)
+	quic, either := rule.patterns[1], rule.patterns[2]
+
+	cases := map[interface{}]bool{
+		"www.google.com": false, // decided at connection time
+		&Flow{Network: "udp", Host: "www.google.com"}:        true,
+		&Flow{Network: "tcp", Host: "www.google.com"}:        false,
+		&Flow{Network: "udp", Host: "www.example.com"}:       false,
+		&Flow{Network: "udp", DstIP: net.ParseIP("1.2.3.4")}: false,
+	}
+	checkCases(t, "", quic, cases)
+
+	cases = map[interface{}]bool{
+		"www.google.com":           false,
+		"www.example.com":          true,
+		uint32(0xc0a80101):         true, // 192.168.1.1
+		&Flow{Host: "example.com"}: false,
+	}
+	checkCases(t, "B", either, cases)
+
+	// values its children never handle are not matched
+	notGoogle := either.(*LogicalPattern).patterns[1]
+	checkCases(t, "A", notGoogle, map[interface{}]bool{
+		"www.example.com":  true,
+		uint32(0x01020304): false,
+	})
+	if notGoogle.Match(net.ParseIP("1.2.3.4")) || either.Match(net.ParseIP("1.2.3.4")) {
+		t.Error("ip should not be matched by not of domain pattern")
+	}
+
+	// children are shared
+	rule.patterns[1].(*LogicalPattern).patterns[0].Add("example.com")
+	if either.Match("www.example.com") {
+		t.Error("child pattern should be shared")
+	}
+}
+
+func TestLogicalPatternCycle(t *testing.T) {
+	patterns := map[string]*PatternConfig{
+		"google": {Scheme: schemeDomainSuffix, V: []string{"google.com"}},
+		"a":      {Scheme: schemeAnd, V: []string{"google", "b"}},
+		"b":      {Scheme: schemeOr, V: []string{"c"}},
+		"c":      {Scheme: schemeNot, V: []string{"a"}},
+	}
+	if err := checkLogicalPatterns(patterns); err == nil {
+		t.Fatal("cycle not found")
+	}
+
+	patterns["c"].V = []string{"google"}
+	if err := checkLogicalPatterns(patterns); err != nil {
+		t.Fatal(err)
+	}
+
+	patterns["c"].V = []string{"unknown"}
+	if err := checkLogicalPatterns(patterns); err == nil {
+		t.Fatal("unknown pattern not found")
+	}
+}
+
+func BenchmarkDomainRegexPattern(b *testing.B) {
+	var exprs []string
+	for i := 0; i < 500; i++ {
+		exprs = append(exprs, fmt.Sprintf(`^ad%d[a-z]*\.tracker%d\.(com|net)$`, i, i))
+	}
+	pattern := NewDomainRegexPattern("domain-regex", "", "A", exprs)
+	queries := []string{"ad499x.tracker499.net", "www.example.com", "ad1.tracker2.com"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pattern.Match(queries[i%len(queries)])
+	}
+}
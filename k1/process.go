@@ -0,0 +1,422 @@
+package k1
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// owner of a locally originated flow
+type Process struct {
+	Pid  int // 0 if the socket is found but its process isn't
+	Uid  int
+	Name string
+	Path string
+}
+
+func (p *Process) String() string {
+	return fmt.Sprintf("%s(%d) uid %d", p.Name, p.Pid, p.Uid)
+}
+
+var errNoSocket = errors.New("no socket")
+
+// st of listening tcp socket, its local port may equal source port of a flow
+const tcpListen = "0A"
+
+// /proc/net prints addresses as u32 words in host byte order
+var hostLittleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// address in /proc/net/{tcp,udp}{,6}, eg: 0100007F:0050
+func parseProcAddr(s string) (net.IP, uint16, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return nil, 0, fmt.Errorf("invalid address: %s", s)
+	}
+	ip, err := hex.DecodeString(s[:i])
+	if err != nil || (len(ip) != net.IPv4len && len(ip) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid address: %s", s)
+	}
+	port, err := strconv.ParseUint(s[i+1:], 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port: %s", s)
+	}
+	if hostLittleEndian {
+		for w := 0; w < len(ip); w += 4 {
+			ip[w], ip[w+1], ip[w+2], ip[w+3] = ip[w+3], ip[w+2], ip[w+1], ip[w]
+		}
+	}
+	return net.IP(ip), uint16(port), nil
+}
+
+// uid and inode of socket from src to dst in /proc/net/<network>{,6}
+func findSocket(root, network string, srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16) (uid int, inode string, err error) {
+	for _, name := range []string{network, network + "6"} {
+		f, err := os.Open(filepath.Join(root, "net", name))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 || fields[9] == "0" || network == "tcp" && fields[3] == tcpListen {
+				continue
+			}
+			localIP, localPort, err := parseProcAddr(fields[1])
+			if err != nil || localPort != srcPort || !(localIP.Equal(srcIP) || localIP.IsUnspecified()) {
+				continue
+			}
+			// unconnected udp socket has no remote address
+			remoteIP, remotePort, err := parseProcAddr(fields[2])
+			if err != nil || remotePort != 0 && (remotePort != dstPort || !remoteIP.Equal(dstIP)) {
+				continue
+			}
+			if uid, err = strconv.Atoi(fields[7]); err != nil {
+				continue
+			}
+			f.Close()
+			return uid, fields[9], nil
+		}
+		f.Close()
+	}
+	return 0, "", errNoSocket
+}
+
+// process directories of user, socket is owned by the user creating it
+func findUserProcesses(root string, uid int) []string {
+	var found []string
+	user := strconv.Itoa(uid)
+	dirs, _ := filepath.Glob(filepath.Join(root, "[0-9]*"))
+	for _, dir := range dirs {
+		status, err := ioutil.ReadFile(filepath.Join(dir, "status"))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(status), "\n") {
+			// Uid: real effective saved fs
+			fields := strings.Fields(line)
+			if len(fields) == 0 || fields[0] != "Uid:" {
+				continue
+			}
+			for _, id := range fields[1:] {
+				if id == user {
+					found = append(found, dir)
+					break
+				}
+			}
+			break
+		}
+	}
+	return found
+}
+
+// process of user holding socket inode, nil if not found.
+// only fds of the user's processes are read
+func findInodeProcess(root, inode string, uid int) *Process {
+	link := "socket:[" + inode + "]"
+	for _, dir := range findUserProcesses(root, uid) {
+		fds, _ := filepath.Glob(filepath.Join(dir, "fd", "*"))
+		for _, fd := range fds {
+			if target, err := os.Readlink(fd); err != nil || target != link {
+				continue
+			}
+			pid, _ := strconv.Atoi(filepath.Base(dir))
+			p := &Process{Pid: pid}
+			p.Path, _ = os.Readlink(filepath.Join(dir, "exe"))
+			if p.Path != "" {
+				p.Name = filepath.Base(p.Path)
+			} else if comm, err := ioutil.ReadFile(filepath.Join(dir, "comm")); err == nil {
+				p.Name = strings.TrimSpace(string(comm))
+			}
+			return p
+		}
+	}
+	return nil
+}
+
+// owner process of socket from src to dst, root is mount point of procfs
+func findProcess(root, network string, srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16) (*Process, error) {
+	uid, inode, err := findSocket(root, network, srcIP, srcPort, dstIP, dstPort)
+	if err != nil {
+		return nil, err
+	}
+	p := findInodeProcess(root, inode, uid)
+	if p == nil {
+		p = &Process{}
+	}
+	p.Uid = uid
+	return p, nil
+}
+
+// ip of an interface of local host
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// owner process of session if it's originated from local host, resolved once
+func (session *NatSession) Process(network string) *Process {
+	session.processOnce.Do(func() {
+		if !isLocalIP(session.srcIP) {
+			return
+		}
+		p, err := lookupProcess(network, session.srcIP, session.srcPort, session.dstIP, session.dstPort)
+		if err != nil {
+			logger.Debugf("[process] %s %s:%d > %s:%d: %v", network, session.srcIP, session.srcPort, session.dstIP, session.dstPort, err)
+			return
+		}
+		logger.Debugf("[process] %s %s:%d > %s:%d: %v", network, session.srcIP, session.srcPort, session.dstIP, session.dstPort, p)
+		session.process = p
+	})
+	return session.process
+}
+
+// PROCESS-NAME, base name of executable
+type ProcessNamePattern struct {
+	name   string
+	policy string
+	proxy  string
+	vals   map[string]bool
+}
+
+func (p *ProcessNamePattern) Name() string {
+	return p.name
+}
+
+func (p *ProcessNamePattern) Policy() string {
+	return p.policy
+}
+
+func (p *ProcessNamePattern) Proxy() string {
+	return p.proxy
+}
+
+func (p *ProcessNamePattern) Match(val interface{}) bool {
+	flow, ok := val.(*Flow)
+	if !ok {
+		return false
+	}
+	process := flow.process()
+	return process != nil && process.Name != "" && p.vals[process.Name]
+}
+
+func (p *ProcessNamePattern) Add(val string) {
+	if len(val) > 0 {
+		p.vals[val] = true
+	}
+}
+
+func (p *ProcessNamePattern) Remove(val string) {
+	delete(p.vals, val)
+}
+
+func (p *ProcessNamePattern) Scheme() string {
+	return schemeProcessName
+}
+
+func (p *ProcessNamePattern) MarshalJSON() ([]byte, error) {
+	return jsoniter.Marshal(map[string]interface{}{
+		"name":   p.name,
+		"policy": p.policy,
+		"proxy":  p.proxy,
+		"vals":   p.vals,
+		"schema": p.Scheme(),
+	})
+}
+
+func NewProcessNamePattern(name, policy, proxy string, vals []string) Pattern {
+	p := new(ProcessNamePattern)
+	p.name = name
+	p.policy = policy
+	p.proxy = proxy
+	p.vals = make(map[string]bool)
+	for _, val := range vals {
+		p.Add(val)
+	}
+	return p
+}
+
+// PROCESS-PATH, path of executable, or directory containing it if ends with "/"
+type ProcessPathPattern struct {
+	name   string
+	policy string
+	proxy  string
+	vals   map[string]bool
+}
+
+func isValidProcessPath(val string) bool {
+	return filepath.IsAbs(val)
+}
+
+func (p *ProcessPathPattern) Name() string {
+	return p.name
+}
+
+func (p *ProcessPathPattern) Policy() string {
+	return p.policy
+}
+
+func (p *ProcessPathPattern) Proxy() string {
+	return p.proxy
+}
+
+func (p *ProcessPathPattern) Match(val interface{}) bool {
+	flow, ok := val.(*Flow)
+	if !ok {
+		return false
+	}
+	process := flow.process()
+	if process == nil || process.Path == "" {
+		return false
+	}
+	if p.vals[process.Path] {
+		return true
+	}
+	for dir := range p.vals {
+		if strings.HasSuffix(dir, "/") && strings.HasPrefix(process.Path, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ProcessPathPattern) Add(val string) {
+	if isValidProcessPath(val) {
+		p.vals[val] = true
+	}
+}
+
+func (p *ProcessPathPattern) Remove(val string) {
+	delete(p.vals, val)
+}
+
+func (p *ProcessPathPattern) Scheme() string {
+	return schemeProcessPath
+}
+
+func (p *ProcessPathPattern) MarshalJSON() ([]byte, error) {
+	return jsoniter.Marshal(map[string]interface{}{
+		"name":   p.name,
+		"policy": p.policy,
+		"proxy":  p.proxy,
+		"vals":   p.vals,
+		"schema": p.Scheme(),
+	})
+}
+
+func NewProcessPathPattern(name, policy, proxy string, vals []string) Pattern {
+	p := new(ProcessPathPattern)
+	p.name = name
+	p.policy = policy
+	p.proxy = proxy
+	p.vals = make(map[string]bool)
+	for _, val := range vals {
+		p.Add(val)
+	}
+	return p
+}
+
+// uid of user name or number
+func parseUID(val string) (string, error) {
+	if _, err := strconv.ParseUint(val, 10, 32); err == nil {
+		return val, nil
+	}
+	u, err := user.Lookup(val)
+	if err != nil {
+		return "", fmt.Errorf("invalid uid: %s", val)
+	}
+	return u.Uid, nil
+}
+
+// UID, owner of process by user name or number
+type UIDPattern struct {
+	name   string
+	policy string
+	proxy  string
+	vals   map[string]bool // uid numbers
+}
+
+func (p *UIDPattern) Name() string {
+	return p.name
+}
+
+func (p *UIDPattern) Policy() string {
+	return p.policy
+}
+
+func (p *UIDPattern) Proxy() string {
+	return p.proxy
+}
+
+func (p *UIDPattern) Match(val interface{}) bool {
+	flow, ok := val.(*Flow)
+	if !ok {
+		return false
+	}
+	process := flow.process()
+	return process != nil && p.vals[strconv.Itoa(process.Uid)]
+}
+
+func (p *UIDPattern) Add(val string) {
+	uid, err := parseUID(val)
+	if err != nil {
+		logger.Errorf("[pattern] %s: %v", p.name, err)
+		return
+	}
+	p.vals[uid] = true
+}
+
+func (p *UIDPattern) Remove(val string) {
+	if uid, err := parseUID(val); err == nil {
+		delete(p.vals, uid)
+	}
+}
+
+func (p *UIDPattern) Scheme() string {
+	return schemeUID
+}
+
+func (p *UIDPattern) MarshalJSON() ([]byte, error) {
+	return jsoniter.Marshal(map[string]interface{}{
+		"name":   p.name,
+		"policy": p.policy,
+		"proxy":  p.proxy,
+		"vals":   p.vals,
+		"schema": p.Scheme(),
+	})
+}
+
+func NewUIDPattern(name, policy, proxy string, vals []string) Pattern {
+	p := new(UIDPattern)
+	p.name = name
+	p.policy = policy
+	p.proxy = proxy
+	p.vals = make(map[string]bool)
+	for _, val := range vals {
+		p.Add(val)
+	}
+	return p
+}
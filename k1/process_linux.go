@@ -0,0 +1,9 @@
+package k1
+
+import "net"
+
+const procRoot = "/proc"
+
+func lookupProcess(network string, srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16) (*Process, error) {
+	return findProcess(procRoot, network, srcIP, srcPort, dstIP, dstPort)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package k1
+
+import (
+	"errors"
+	"net"
+)
+
+var errProcessUnsupported = errors.New("process lookup is unsupported on this os")
+
+func lookupProcess(network string, srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16) (*Process, error) {
+	return nil, errProcessUnsupported
+}
@@ -0,0 +1,161 @@
+package k1
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// address printed by /proc/net of host
+func testProcAddr(ip net.IP, port uint16) string {
+	b := []byte(ip)
+	if ip4 := ip.To4(); ip4 != nil {
+		b = []byte(ip4)
+	}
+	b = append([]byte(nil), b...)
+	if hostLittleEndian {
+		for w := 0; w < len(b); w += 4 {
+			b[w], b[w+1], b[w+2], b[w+3] = b[w+3], b[w+2], b[w+1], b[w]
+		}
+	}
+	return fmt.Sprintf("%s:%04X", strings.ToUpper(hex.EncodeToString(b)), port)
+}
+
+func testProcSocket(local, remote string, uid int, inode string) string {
+	return testProcSocketState(local, remote, "01", uid, inode)
+}
+
+func testProcSocketState(local, remote, st string, uid int, inode string) string {
+	return fmt.Sprintf("   0: %s %s %s 00000000:00000000 00:00000000 00000000 %5d        0 %s 1 0000000000000000 20 4 30 10 -1\n",
+		local, remote, st, uid, inode)
+}
+
+func testProcStatus(uid int) []byte {
+	return []byte(fmt.Sprintf("Name:\ttest\nUid:\t%d\t%d\t%d\t%d\n", uid, uid, uid, uid))
+}
+
+func TestParseProcAddr(t *testing.T) {
+	for _, addr := range []string{"10.0.0.1:443", "[2001:db8::1]:53", "0.0.0.0:0"} {
+		host, port, _ := net.SplitHostPort(addr)
+		var p uint16
+		fmt.Sscan(port, &p)
+		ip, parsedPort, err := parseProcAddr(testProcAddr(net.ParseIP(host), p))
+		if err != nil || !ip.Equal(net.ParseIP(host)) || parsedPort != p {
+			t.Errorf("parse %s: %s %d %v", addr, ip, parsedPort, err)
+		}
+	}
+	for _, s := range []string{"0100007F", "0100007F:XX", "01007F:0050"} {
+		if _, _, err := parseProcAddr(s); err == nil {
+			t.Errorf("parse %s should fail", s)
+		}
+	}
+}
+
+func TestFindProcess(t *testing.T) {
+	root, err := ioutil.TempDir("", "kone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	src := net.ParseIP("10.192.0.1")
+	dst := net.ParseIP("10.192.0.100")
+	header := "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+
+	os.MkdirAll(filepath.Join(root, "net"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "net", "tcp"), []byte(header+
+		testProcSocket(testProcAddr(src, 40000), testProcAddr(dst, 80), 1000, "0")+ // time wait
+		testProcSocket(testProcAddr(src, 40000), testProcAddr(dst, 443), 1000, "1001")+
+		testProcSocketState(testProcAddr(net.IPv4zero, 40002), testProcAddr(net.IPv4zero, 0), tcpListen, 1000, "1004")), 0644)
+	ioutil.WriteFile(filepath.Join(root, "net", "tcp6"), []byte(header+
+		testProcSocket(testProcAddr(src, 40001), testProcAddr(dst, 443), 0, "1002")), 0644)
+	ioutil.WriteFile(filepath.Join(root, "net", "udp"), []byte(header+
+		testProcSocket(testProcAddr(net.IPv4zero, 5353), testProcAddr(net.IPv4zero, 0), 1000, "1003")), 0644)
+
+	os.MkdirAll(filepath.Join(root, "123", "fd"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "123", "status"), testProcStatus(1000), 0644)
+	os.Symlink("/usr/bin/git", filepath.Join(root, "123", "exe"))
+	os.Symlink("/dev/null", filepath.Join(root, "123", "fd", "0"))
+	os.Symlink("socket:[1001]", filepath.Join(root, "123", "fd", "3"))
+	os.MkdirAll(filepath.Join(root, "456", "fd"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "456", "status"), testProcStatus(1000), 0644)
+	ioutil.WriteFile(filepath.Join(root, "456", "comm"), []byte("avahi-daemon\n"), 0644)
+	os.Symlink("socket:[1003]", filepath.Join(root, "456", "fd", "7"))
+	// fds of other users are not read
+	os.MkdirAll(filepath.Join(root, "789", "fd"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "789", "status"), testProcStatus(1000), 0644)
+	os.Symlink("socket:[1002]", filepath.Join(root, "789", "fd", "5"))
+
+	cases := []struct {
+		network string
+		srcPort uint16
+		dstPort uint16
+		process *Process
+	}{
+		{"tcp", 40000, 443, &Process{Pid: 123, Uid: 1000, Name: "git", Path: "/usr/bin/git"}},
+		{"tcp", 40001, 443, &Process{Uid: 0}}, // socket of other process namespace
+		{"udp", 5353, 5353, &Process{Pid: 456, Uid: 1000, Name: "avahi-daemon"}},
+		{"tcp", 40000, 80, nil},
+		{"tcp", 40002, 443, nil}, // listening socket
+		{"udp", 40000, 443, nil},
+	}
+	for _, c := range cases {
+		p, err := findProcess(root, c.network, src, c.srcPort, dst, c.dstPort)
+		if c.process == nil {
+			if err == nil {
+				t.Errorf("%s %d > %d: should not be found, %v", c.network, c.srcPort, c.dstPort, p)
+			}
+			continue
+		}
+		if err != nil || *p != *c.process {
+			t.Errorf("%s %d > %d: %+v %v, expected %+v", c.network, c.srcPort, c.dstPort, p, err, c.process)
+		}
+	}
+}
+
+func TestProcessPatterns(t *testing.T) {
+	owner := func(p *Process) func() *Process {
+		return func() *Process { return p }
+	}
+	git := &Flow{Owner: owner(&Process{Pid: 1, Uid: 1000, Name: "git", Path: "/usr/bin/git"})}
+	firefox := &Flow{Owner: owner(&Process{Pid: 2, Uid: 1000, Name: "firefox", Path: "/usr/lib/firefox/firefox"})}
+	apt := &Flow{Owner: owner(&Process{Pid: 3, Uid: 0, Name: "http", Path: "/usr/lib/apt/methods/http"})}
+	remote := &Flow{SrcIP: net.ParseIP("192.168.1.2")}
+
+	proxy := "P"
+	pattern := NewProcessNamePattern("process-name", "", proxy, []string{"git", "ssh"})
+	checkCases(t, proxy, pattern, map[interface{}]bool{
+		git:     true,
+		firefox: false,
+		remote:  false,
+		"git":   false,
+	})
+
+	pattern = NewProcessPathPattern("process-path", "", proxy, []string{"/usr/lib/firefox/", "/usr/bin/git", "firefox"})
+	checkCases(t, proxy, pattern, map[interface{}]bool{
+		git:     true,
+		firefox: true,
+		apt:     false,
+		remote:  false,
+	})
+
+	pattern = NewUIDPattern("uid", "", proxy, []string{"root", "nosuchuser"})
+	checkCases(t, proxy, pattern, map[interface{}]bool{
+		git:    false,
+		apt:    true,
+		remote: false,
+	})
+	pattern.Add("1000")
+	if !pattern.Match(git) {
+		t.Error("added uid should be matched")
+	}
+	pattern.Remove("0")
+	if pattern.Match(apt) {
+		t.Error("removed uid should not be matched")
+	}
+}
@@ -0,0 +1,529 @@
+package k1
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	providerFormatDomain = "domain"
+	providerFormatCIDR   = "cidr"
+	providerFormatHosts  = "hosts"
+	providerFormatClash  = "clash"
+	providerFormatSurge  = "surge"
+
+	providerDefaultInterval = 86400
+	providerCheckInterval   = time.Minute
+	providerFetchTimeout    = time.Minute
+)
+
+var providerMaxSize int64 = 64 << 20 // larger lists are rejected
+
+func isValidProviderFormat(format string) bool {
+	switch format {
+	case providerFormatDomain, providerFormatCIDR, providerFormatHosts, providerFormatClash, providerFormatSurge:
+		return true
+	}
+	return false
+}
+
+func isProviderURL(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+}
+
+// names in hosts files that are not rules
+var providerHostsIgnored = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"0.0.0.0":               true,
+}
+
+func trimProviderLine(line string) string {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") || strings.HasPrefix(line, ";") {
+		return ""
+	}
+	return line
+}
+
+// entries of a rule list, either a value or a `TYPE,value` rule
+func parseProviderEntries(data []byte, format string) []string {
+	var entries []string
+	inPayload := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 4096), 1<<20)
+	for scanner.Scan() {
+		line := trimProviderLine(scanner.Text())
+		if line == "" {
+			continue
+		}
+		switch format {
+		case providerFormatHosts:
+			fields := parseHostsLine(line)
+			if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+				continue
+			}
+			for _, name := range fields[1:] {
+				if !providerHostsIgnored[strings.ToLower(name)] {
+					entries = append(entries, name)
+				}
+			}
+		case providerFormatClash:
+			// payload list of yaml
+			if strings.HasSuffix(line, ":") {
+				inPayload = line == "payload:"
+				continue
+			}
+			if !inPayload || !strings.HasPrefix(line, "-") {
+				continue
+			}
+			if line = strings.Trim(strings.TrimSpace(line[1:]), `'"`); line != "" {
+				entries = append(entries, line)
+			}
+		case providerFormatSurge:
+			entries = append(entries, line)
+		default:
+			if fields := strings.Fields(line); len(fields) > 0 {
+				entries = append(entries, fields[0])
+			}
+		}
+	}
+	return entries
+}
+
+// value of entry for pattern of scheme, rules of other types are skipped
+func providerValue(entry, scheme string) (string, bool) {
+	if i := strings.IndexByte(entry, ','); i >= 0 {
+		fields := strings.Split(entry, ",")
+		typ := strings.ToUpper(strings.TrimSpace(fields[0]))
+		if typ == "IP-CIDR6" {
+			typ = schemeIPCIDR
+		}
+		if typ != scheme {
+			return "", false
+		}
+		entry = strings.TrimSpace(fields[1])
+	} else if scheme != schemeDomainWildcard && scheme != schemeDomainRegex {
+		// `+.example.com` and `.example.com` of domain lists
+		entry = strings.TrimPrefix(entry, "+.")
+		entry = strings.TrimPrefix(entry, "*.")
+		entry = strings.TrimPrefix(entry, ".")
+	}
+	return entry, entry != ""
+}
+
+type ProviderStatus struct {
+	Name    string
+	Url     string
+	Format  string
+	Count   int       // entries of the list
+	Updated time.Time // last successful refresh
+	Checked time.Time // last refresh
+	Error   string    // error of last refresh
+}
+
+// rule list shared by patterns, refreshed periodically
+type Provider struct {
+	name      string
+	url       string
+	format    string
+	cacheFile string
+	interval  time.Duration
+	proxy     string
+	providers *Providers
+
+	lock     sync.Mutex // protect entries, status and patterns
+	entries  []string
+	status   ProviderStatus
+	patterns []*ProviderPattern
+}
+
+func (p *Provider) Entries() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.entries
+}
+
+func (p *Provider) Status() ProviderStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.status
+}
+
+func (p *Provider) subscribe(pattern *ProviderPattern) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.patterns = append(p.patterns, pattern)
+}
+
+func (p *Provider) unsubscribe(pattern *ProviderPattern) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, subscribed := range p.patterns {
+		if subscribed == pattern {
+			p.patterns = append(p.patterns[:i:i], p.patterns[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *Provider) dial(network, addr string) (net.Conn, error) {
+	if p.proxy != "" && p.providers.proxies != nil {
+		return p.providers.proxies.Dial(network, p.proxy, addr)
+	}
+	return net.DialTimeout(network, addr, providerFetchTimeout)
+}
+
+// a truncated list would drop entries silently, larger lists are rejected
+func readProviderList(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, providerMaxSize+1))
+	if err == nil && int64(len(data)) > providerMaxSize {
+		return nil, fmt.Errorf("list is larger than %d bytes", providerMaxSize)
+	}
+	return data, err
+}
+
+func (p *Provider) fetch() ([]byte, error) {
+	if !isProviderURL(p.url) {
+		f, err := os.Open(p.url)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return readProviderList(f)
+	}
+
+	client := &http.Client{
+		Timeout:   providerFetchTimeout,
+		Transport: &http.Transport{Dial: p.dial},
+	}
+	rsp, err := client.Get(p.url)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http status: %s", rsp.Status)
+	}
+	return readProviderList(rsp.Body)
+}
+
+func (p *Provider) update(data []byte, updated time.Time) {
+	entries := parseProviderEntries(data, p.format)
+
+	p.lock.Lock()
+	p.entries = entries
+	p.status.Count = len(entries)
+	p.status.Updated = updated
+	p.status.Error = ""
+	patterns := p.patterns
+	p.lock.Unlock()
+
+	// new values are swapped into patterns
+	for _, pattern := range patterns {
+		pattern.rebuild()
+	}
+}
+
+// fetch the list, patterns keep the old values on failure
+func (p *Provider) Refresh() error {
+	data, err := p.fetch()
+
+	now := time.Now()
+	p.lock.Lock()
+	p.status.Checked = now
+	if err != nil {
+		p.status.Error = err.Error()
+	}
+	p.lock.Unlock()
+	if err != nil {
+		logger.Errorf("[provider] %s: refresh %s failed: %v", p.name, p.url, err)
+		return err
+	}
+
+	p.update(data, now)
+	logger.Infof("[provider] %s: %d entries from %s", p.name, len(p.Entries()), p.url)
+
+	if p.cacheFile != "" && isProviderURL(p.url) {
+		if err := writeFileAtomic(p.cacheFile, data); err != nil {
+			logger.Errorf("[provider] %s: save cache failed: %v", p.name, err)
+		}
+	}
+	return nil
+}
+
+// read local file, or cache of url. url without cache is fetched once serving,
+// when proxies are ready
+func (p *Provider) load() {
+	if !isProviderURL(p.url) {
+		p.Refresh()
+		return
+	}
+	if p.cacheFile == "" {
+		return
+	}
+	if info, err := os.Stat(p.cacheFile); err == nil {
+		if data, err := ioutil.ReadFile(p.cacheFile); err == nil {
+			p.update(data, info.ModTime())
+			p.lock.Lock()
+			p.status.Checked = info.ModTime()
+			p.lock.Unlock()
+		}
+	}
+}
+
+func (p *Provider) due(now time.Time) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.status.Checked.IsZero() {
+		return true
+	}
+	return p.interval > 0 && now.Sub(p.status.Checked) >= p.interval
+}
+
+type Providers struct {
+	providers map[string]*Provider
+	proxies   *Proxies // set once proxies are created
+}
+
+func (ps *Providers) Get(name string) *Provider {
+	if ps == nil {
+		return nil
+	}
+	return ps.providers[name]
+}
+
+// status of all providers, sorted by name
+func (ps *Providers) Status() []ProviderStatus {
+	var status []ProviderStatus
+	if ps == nil {
+		return status
+	}
+	for _, p := range ps.providers {
+		status = append(status, p.Status())
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Name < status[j].Name })
+	return status
+}
+
+func (ps *Providers) Serve() error {
+	ticker := time.NewTicker(providerCheckInterval)
+	defer ticker.Stop()
+	for now := time.Now(); ; now = <-ticker.C {
+		for _, p := range ps.providers {
+			if p.due(now) {
+				p.Refresh()
+			}
+		}
+	}
+}
+
+func NewProviders(config map[string]*ProviderConfig) *Providers {
+	ps := &Providers{providers: make(map[string]*Provider)}
+	for name, cfg := range config {
+		p := &Provider{
+			name:      name,
+			url:       cfg.Url,
+			format:    cfg.Format,
+			cacheFile: cfg.Cache,
+			interval:  time.Duration(cfg.Interval) * time.Second,
+			proxy:     cfg.Proxy,
+			providers: ps,
+		}
+		p.status = ProviderStatus{Name: name, Url: cfg.Url, Format: cfg.Format}
+		p.load()
+		ps.providers[name] = p
+	}
+	return ps
+}
+
+func checkProviders(cfg *KoneConfig) error {
+	for name, provider := range cfg.Provider {
+		if provider.Url == "" {
+			return fmt.Errorf("[check provider %q] no url", name)
+		}
+		if provider.Format == "" {
+			provider.Format = providerFormatDomain
+		}
+		provider.Format = strings.ToLower(provider.Format)
+		if !isValidProviderFormat(provider.Format) {
+			return fmt.Errorf("[check provider %q] invalid format: %s", name, provider.Format)
+		}
+		if provider.Interval == 0 && isProviderURL(provider.Url) {
+			provider.Interval = providerDefaultInterval
+		}
+		if !cfg.isValidProxy(provider.Proxy) {
+			return fmt.Errorf("[check provider %q] invalid proxy: %s", name, provider.Proxy)
+		}
+		logger.Infof("[check provider %q] %s, format: %s, refresh every %ds", name, provider.Url, provider.Format, provider.Interval)
+	}
+
+	for name, pattern := range cfg.Pattern {
+		if len(pattern.Provider) > 0 && isLogicalScheme(pattern.Scheme) {
+			return fmt.Errorf("[check pattern %q] %s pattern can't use provider", name, pattern.Scheme)
+		}
+		for _, provider := range pattern.Provider {
+			if _, ok := cfg.Provider[provider]; !ok {
+				return fmt.Errorf("[check pattern %q] invalid provider: %q", name, provider)
+			}
+		}
+	}
+	return nil
+}
+
+// pattern with values from providers, rebuilt and swapped on refresh.
+// values added or removed through api are kept
+type ProviderPattern struct {
+	name      string
+	config    PatternConfig
+	providers []*Provider
+
+	current atomic.Value // Pattern
+
+	lock    sync.Mutex // protect added, removed and rebuild
+	added   map[string]bool
+	removed map[string]bool
+}
+
+func (p *ProviderPattern) load() Pattern {
+	return p.current.Load().(Pattern)
+}
+
+func (p *ProviderPattern) rebuild() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var vals []string
+	found := make(map[string]bool)
+	add := func(val string) {
+		if p.removed[val] {
+			found[val] = true
+		} else {
+			vals = append(vals, val)
+		}
+	}
+	for _, val := range p.config.V {
+		add(val)
+	}
+	for _, provider := range p.providers {
+		for _, entry := range provider.Entries() {
+			if val, ok := providerValue(entry, p.config.Scheme); ok {
+				add(val)
+			}
+		}
+	}
+	for val := range p.added {
+		add(val)
+	}
+
+	if pattern := CreatePattern(p.name, &PatternConfig{
+		Policy: p.config.Policy,
+		Proxy:  p.config.Proxy,
+		Scheme: p.config.Scheme,
+		V:      vals,
+	}); pattern != nil {
+		// eg: a cidr inside a listed one
+		for val := range p.removed {
+			if !found[val] {
+				pattern.Remove(val)
+			}
+		}
+		p.current.Store(pattern)
+	}
+}
+
+func (p *ProviderPattern) Name() string {
+	return p.name
+}
+
+func (p *ProviderPattern) Policy() string {
+	return p.config.Policy
+}
+
+func (p *ProviderPattern) Proxy() string {
+	return p.config.Proxy
+}
+
+func (p *ProviderPattern) Match(val interface{}) bool {
+	return p.load().Match(val)
+}
+
+// values are swapped in by rebuild, matching never sees a pattern being changed
+func (p *ProviderPattern) Add(val string) {
+	p.Update([]string{val}, nil)
+}
+
+func (p *ProviderPattern) Remove(val string) {
+	p.Update(nil, []string{val})
+}
+
+// add and remove values, then rebuild once
+func (p *ProviderPattern) Update(added, removed []string) {
+	p.lock.Lock()
+	for _, val := range added {
+		p.added[val] = true
+		delete(p.removed, val)
+	}
+	for _, val := range removed {
+		delete(p.added, val)
+		p.removed[val] = true
+	}
+	p.lock.Unlock()
+	p.rebuild()
+}
+
+// stop receiving values of providers
+func (p *ProviderPattern) close() {
+	for _, provider := range p.providers {
+		provider.unsubscribe(p)
+	}
+}
+
+func (p *ProviderPattern) Scheme() string {
+	return p.config.Scheme
+}
+
+func (p *ProviderPattern) MarshalJSON() ([]byte, error) {
+	return p.load().MarshalJSON()
+}
+
+func NewProviderPattern(name string, config *PatternConfig, providers *Providers) Pattern {
+	return newProviderPattern(name, config, providers, nil)
+}
+
+// values of edit are kept from the first build
+func newProviderPattern(name string, config *PatternConfig, providers *Providers, edit *PatternEdit) Pattern {
+	p := new(ProviderPattern)
+	p.name = name
+	p.config = *config
+	edit = edit.clone()
+	p.added = edit.Added
+	p.removed = edit.Removed
+	// pattern of unknown scheme is never built, nothing is subscribed
+	if patternSchemes[config.Scheme] == nil {
+		return nil
+	}
+	for _, provider := range config.Provider {
+		if provider := providers.Get(provider); provider != nil {
+			p.providers = append(p.providers, provider)
+			provider.subscribe(p)
+		}
+	}
+	p.rebuild()
+	return p
+}
@@ -0,0 +1,215 @@
+package k1
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseProviderEntries(t *testing.T) {
+	cases := []struct {
+		format string
+		data   string
+		scheme string
+		vals   []string
+	}{
+		{providerFormatDomain, "# comment\nexample.com\n+.google.com\n\n.youtube.com extra\n", schemeDomainSuffix,
+			[]string{"example.com", "google.com", "youtube.com"}},
+		{providerFormatCIDR, "10.0.0.0/8\n2001:db8::/32\n", schemeIPCIDR,
+			[]string{"10.0.0.0/8", "2001:db8::/32"}},
+		{providerFormatHosts, "127.0.0.1 localhost\n0.0.0.0 ads.example.com ad.example.net # ads\n::1 ip6-localhost\n", schemeDomain,
+			[]string{"ads.example.com", "ad.example.net"}},
+		{providerFormatClash, "# rule set\npayload:\n  - DOMAIN-SUFFIX,google.com\n  - 'DOMAIN,www.example.com'\n  - \"+.youtube.com\"\n  - IP-CIDR,8.8.8.0/24,no-resolve\n", schemeDomainSuffix,
+			[]string{"google.com", "youtube.com"}},
+		{providerFormatSurge, "DOMAIN-SUFFIX,google.com\n// comment\nIP-CIDR,8.8.8.0/24,no-resolve\nIP-CIDR6,2001:4860::/32\n", schemeIPCIDR,
+			[]string{"8.8.8.0/24", "2001:4860::/32"}},
+	}
+	for _, c := range cases {
+		var vals []string
+		for _, entry := range parseProviderEntries([]byte(c.data), c.format) {
+			if val, ok := providerValue(entry, c.scheme); ok {
+				vals = append(vals, val)
+			}
+		}
+		if strings.Join(vals, " ") != strings.Join(c.vals, " ") {
+			t.Errorf("%s: %v, expected %v", c.format, vals, c.vals)
+		}
+	}
+}
+
+// rule list server, content can be changed
+type testListServer struct {
+	lock   sync.Mutex
+	status int
+	body   string
+}
+
+func (s *testListServer) set(status int, body string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status, s.body = status, body
+}
+
+func (s *testListServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	w.WriteHeader(s.status)
+	w.Write([]byte(s.body))
+}
+
+func TestProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	list := &testListServer{status: http.StatusOK, body: "payload:\n  - DOMAIN-SUFFIX,google.com\n  - IP-CIDR,8.8.8.0/24\n"}
+	server := httptest.NewServer(list)
+	defer server.Close()
+
+	localFile := filepath.Join(dir, "local.txt")
+	ioutil.WriteFile(localFile, []byte("example.com\n"), 0644)
+
+	providers := map[string]*ProviderConfig{
+		"remote": {Url: server.URL + "/rules.yaml", Format: providerFormatClash, Cache: filepath.Join(dir, "remote.yaml")},
+		"local":  {Url: localFile},
+	}
+	patterns := map[string]*PatternConfig{
+		"suffix": {Policy: PROXY_POLICY, Proxy: "A", Scheme: schemeDomainSuffix, V: []string{"inline.com"}, Provider: []string{"remote", "local"}},
+		"cidr":   {Policy: PROXY_POLICY, Proxy: "A", Scheme: schemeIPCIDR, Provider: []string{"remote"}},
+	}
+	cfg := &KoneConfig{Provider: providers, Pattern: patterns}
+	if err := checkProviders(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	ps := NewProviders(providers)
+	rule := NewRule(RuleConfig{Pattern: []string{"suffix", "cidr"}}, patterns, ps)
+	suffix, cidr := rule.patterns[1], rule.patterns[2]
+
+	// url is fetched when serving
+	if !suffix.Match("www.example.com") || !suffix.Match("inline.com") || suffix.Match("www.google.com") {
+		t.Fatal("local provider should be loaded")
+	}
+	remote := ps.Get("remote")
+	if !remote.due(remote.Status().Checked) {
+		t.Fatal("remote provider should be fetched")
+	}
+	if err := remote.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if !suffix.Match("www.google.com") || !cidr.Match(net.ParseIP("8.8.8.8")) {
+		t.Fatal("remote provider should be loaded")
+	}
+
+	// edits through api are kept
+	suffix.Add("added.com")
+	suffix.Remove("inline.com")
+
+	list.set(http.StatusOK, "payload:\n  - DOMAIN-SUFFIX,youtube.com\n")
+	if err := remote.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	for domain, expected := range map[string]bool{
+		"www.google.com":  false,
+		"www.youtube.com": true,
+		"added.com":       true,
+		"inline.com":      false,
+		"example.com":     true,
+	} {
+		if suffix.Match(domain) != expected {
+			t.Errorf("match %s after refresh, expected %v", domain, expected)
+		}
+	}
+	if cidr.Match(net.ParseIP("8.8.8.8")) {
+		t.Error("cidr should be swapped")
+	}
+
+	// keep old values on failure
+	list.set(http.StatusInternalServerError, "")
+	if remote.Refresh() == nil || remote.Status().Error == "" {
+		t.Fatal("refresh should fail")
+	}
+	if !suffix.Match("www.youtube.com") || remote.Status().Count != 1 {
+		t.Fatal("old values should be kept")
+	}
+	defer func(size int64) { providerMaxSize = size }(providerMaxSize)
+	providerMaxSize = 64
+	list.set(http.StatusOK, "payload:\n  - DOMAIN-SUFFIX,google.com\n  - DOMAIN-SUFFIX,youtube.com\n  - IP-CIDR,8.8.8.0/24\n")
+	if remote.Refresh() == nil || !suffix.Match("www.youtube.com") || suffix.Match("www.google.com") {
+		t.Fatal("list larger than limit should be rejected")
+	}
+
+	// so are local files
+	ioutil.WriteFile(localFile, []byte(strings.Repeat("example.net\n", 10)), 0644)
+	if ps.Get("local").Refresh() == nil || !suffix.Match("www.example.com") {
+		t.Fatal("local file larger than limit should be rejected")
+	}
+
+	// values edited at once
+	suffix.(*ProviderPattern).Update([]string{"inline.com", "batch.com"}, []string{"added.com"})
+	if !suffix.Match("inline.com") || !suffix.Match("batch.com") || suffix.Match("added.com") {
+		t.Error("batch edits should be applied")
+	}
+
+	// restart without network
+	server.Close()
+	ps = NewProviders(providers)
+	rule = NewRule(RuleConfig{Pattern: []string{"suffix"}}, patterns, ps)
+	if !rule.patterns[1].Match("www.youtube.com") {
+		t.Fatal("remote provider should be loaded from cache")
+	}
+	if ps.Get("remote").due(ps.Get("remote").Status().Checked) {
+		t.Fatal("cached provider is fresh")
+	}
+}
+
+func TestCheckProviders(t *testing.T) {
+	cfg := &KoneConfig{
+		Provider: map[string]*ProviderConfig{"list": {Url: "https://example.com/list.txt"}},
+		Pattern: map[string]*PatternConfig{
+			"suffix": {Scheme: schemeDomainSuffix, Provider: []string{"list"}},
+		},
+	}
+	if err := checkProviders(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if p := cfg.Provider["list"]; p.Format != providerFormatDomain || p.Interval != providerDefaultInterval {
+		t.Fatalf("default values: %+v", p)
+	}
+
+	cfg.Pattern["suffix"].Provider = []string{"unknown"}
+	if checkProviders(cfg) == nil {
+		t.Fatal("unknown provider")
+	}
+	cfg.Pattern["suffix"].Provider = []string{"list"}
+	cfg.Provider["list"].Format = "json"
+	if checkProviders(cfg) == nil {
+		t.Fatal("invalid format")
+	}
+}
+
+func TestProviderPatternUnknownScheme(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	localFile := filepath.Join(dir, "local.txt")
+	ioutil.WriteFile(localFile, []byte("example.com\n"), 0644)
+	ps := NewProviders(map[string]*ProviderConfig{"local": {Url: localFile, Format: providerFormatDomain}})
+	if p := NewProviderPattern("unknown", &PatternConfig{Scheme: "UNKNOWN", Provider: []string{"local"}}, ps); p != nil {
+		t.Fatal("pattern of unknown scheme")
+	}
+	if len(ps.Get("local").patterns) != 0 {
+		t.Error("dropped pattern should not be subscribed")
+	}
+}
@@ -12,8 +12,9 @@ import (
 var errNoProxy = errors.New("no proxy")
 
 type Proxies struct {
-	proxies map[string]*proxy.Proxy
-	dft     string // default proxy name
+	proxies  map[string]*proxy.Proxy
+	resolves map[string]string // proxy name -> proxy-resolve mode
+	dft      string            // default proxy name
 }
 
 func (p *Proxies) Dial(network, proxy, addr string) (net.Conn, error) {
@@ -36,10 +37,19 @@ func (p *Proxies) DefaultDial(network, addr string) (net.Conn, error) {
 	return dialer.Dial(network, addr)
 }
 
+// proxy-resolve mode of proxy, empty if not set
+func (p *Proxies) Resolve(proxy string) string {
+	if proxy == "" {
+		proxy = p.dft
+	}
+	return p.resolves[proxy]
+}
+
 func NewProxies(one *One, config map[string]*ProxyConfig) (*Proxies, error) {
 	p := &Proxies{}
 
 	proxies := make(map[string]*proxy.Proxy)
+	resolves := make(map[string]string)
 	for name, item := range config {
 		proxyDialer, err := proxy.FromUrl(item.Url)
 		if err != nil {
@@ -50,6 +60,9 @@ func NewProxies(one *One, config map[string]*ProxyConfig) (*Proxies, error) {
 			p.dft = name
 		}
 		proxies[name] = proxyDialer
+		if item.Resolve != "" {
+			resolves[name] = item.Resolve
+		}
 
 		// don't hijack proxyDialer domain
 		host := proxyDialer.Url.Host
@@ -57,9 +70,10 @@ func NewProxies(one *One, config map[string]*ProxyConfig) (*Proxies, error) {
 		if index > 0 {
 			host = proxyDialer.Url.Host[:index]
 		}
-		one.rule.DirectDomain(host)
+		one.rules.DirectDomain(host)
 	}
 	p.proxies = proxies
+	p.resolves = resolves
 	logger.Infof("[proxies] default proxy: %q", p.dft)
 	return p, nil
 }
@@ -1,14 +1,54 @@
 package k1
 
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
 type Rule struct {
-	patterns []Pattern
-	final    string
+	patterns  []Pattern
+	final     string
+	hasFlow   bool // has flow level patterns
+	hasSource bool // has source patterns
+
+	// sources of rule, the next rule is created from them
+	config    RuleConfig
+	configs   map[string]*PatternConfig
+	providers *Providers
+	edits     map[string]*PatternEdit
+	direct    []string
+	created   map[string]Pattern // by name, including children of logical patterns
 }
 
-func (rule *Rule) DirectDomain(domain string) {
-	logger.Debugf("[rule] add direct domain: %s", domain)
-	pattern := rule.patterns[0].(*DomainSuffixPattern)
-	pattern.Add(domain)
+// context of a connection through tun
+type Flow struct {
+	Network string // tcp or udp
+	SrcIP   net.IP
+	DstIP   net.IP // real ip, nil if unknown
+	DstPort uint16
+	Host    string // hijacked domain, empty for real ip
+
+	Owner func() *Process // owner process of locally originated flow, may be nil
+}
+
+func (f *Flow) process() *Process {
+	if f.Owner == nil {
+		return nil
+	}
+	return f.Owner()
+}
+
+func (f *Flow) String() string {
+	host := f.Host
+	if host == "" {
+		host = f.DstIP.String()
+	}
+	return fmt.Sprintf("%s %s > %s:%d", f.Network, f.SrcIP, host, f.DstPort)
 }
 
 func (rule *Rule) Reject(val interface{}) bool {
@@ -21,6 +61,39 @@ func (rule *Rule) Reject(val interface{}) bool {
 	return false
 }
 
+// reject `val` queried by client src, src may be nil
+func (rule *Rule) RejectFrom(src net.IP, val interface{}) bool {
+	if rule.hasSource && src != nil {
+		flow := &Flow{SrcIP: src}
+		for _, pattern := range rule.patterns {
+			if isSourceScheme(pattern.Scheme()) && pattern.Policy() == REJECT_POLICY && pattern.Match(flow) {
+				logger.Debugf("[rule] %s %v -> %s: reject", src, val, pattern.Name())
+				return true
+			}
+		}
+	}
+	return rule.Reject(val)
+}
+
+// source pattern matching client src ahead of any pattern matching `val`, nil if none
+func (rule *Rule) SourcePattern(src net.IP, val interface{}) Pattern {
+	if !rule.hasSource || src == nil {
+		return nil
+	}
+	flow := &Flow{SrcIP: src}
+	for _, pattern := range rule.patterns {
+		if isSourceScheme(pattern.Scheme()) {
+			if pattern.Match(flow) {
+				logger.Debugf("[rule] %s %v -> %s: proxy %q", src, val, pattern.Name(), pattern.Proxy())
+				return pattern
+			}
+		} else if pattern.Match(val) {
+			return nil
+		}
+	}
+	return nil
+}
+
 // match a proxy for target `val`
 func (rule *Rule) Proxy(val interface{}) (bool, string) {
 	for _, pattern := range rule.patterns {
@@ -36,17 +109,285 @@ func (rule *Rule) Proxy(val interface{}) (bool, string) {
 	return false, rule.final
 }
 
-func NewRule(config RuleConfig, patterns map[string]*PatternConfig) *Rule {
+// re-evaluate rule for a connection, proxy is decided by domain or ip before.
+// flow level patterns ahead of the first pattern matching host or ip override it
+func (rule *Rule) ProxyFlow(flow *Flow, proxy string) (string, bool) {
+	if !rule.hasFlow {
+		return proxy, false
+	}
+	for _, pattern := range rule.patterns {
+		if pattern.Match(flow) {
+			logger.Debugf("[rule] %v -> %s: proxy %q", flow, pattern.Name(), pattern.Proxy())
+			return pattern.Proxy(), pattern.Policy() == REJECT_POLICY
+		}
+		if flow.Host != "" && pattern.Match(flow.Host) || flow.DstIP != nil && pattern.Match(flow.DstIP) {
+			break
+		}
+	}
+	return proxy, false
+}
+
+// values added and removed through api, replayed on patterns of new rules
+type PatternEdit struct {
+	Added   map[string]bool
+	Removed map[string]bool
+}
+
+func (e *PatternEdit) clone() *PatternEdit {
+	c := &PatternEdit{Added: make(map[string]bool), Removed: make(map[string]bool)}
+	if e != nil {
+		for val := range e.Added {
+			c.Added[val] = true
+		}
+		for val := range e.Removed {
+			c.Removed[val] = true
+		}
+	}
+	return c
+}
+
+// config with the edits, patterns are built once instead of per value.
+// removed values not in config, eg: a cidr inside a configured one, are
+// returned to be removed from the built pattern
+func (e *PatternEdit) config(config *PatternConfig) (*PatternConfig, []string) {
+	if e == nil {
+		return config, nil
+	}
+	c := *config
+	c.V = nil
+	found := make(map[string]bool)
+	for _, val := range config.V {
+		removed := false
+		for r := range e.Removed {
+			if strings.EqualFold(r, val) {
+				found[r] = true
+				removed = true
+			}
+		}
+		if !removed {
+			c.V = append(c.V, val)
+		}
+	}
+	var added, removed []string
+	for val := range e.Added {
+		added = append(added, val)
+	}
+	for val := range e.Removed {
+		if !found[val] {
+			removed = append(removed, val)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	c.V = append(c.V, added...)
+	return &c, removed
+}
+
+// create patterns by name, patterns referred by logical patterns are shared
+type patternBuilder struct {
+	configs   map[string]*PatternConfig
+	providers *Providers
+	edits     map[string]*PatternEdit // built into the pattern before it is shared
+	reuse     map[string]Pattern      // unchanged patterns of the last rule
+	created   map[string]Pattern
+}
+
+func newPatternBuilder(patterns map[string]*PatternConfig, providers *Providers) *patternBuilder {
+	return &patternBuilder{
+		configs:   patterns,
+		providers: providers,
+		created:   make(map[string]Pattern),
+	}
+}
+
+func (b *patternBuilder) create(name string) Pattern {
+	if pattern, ok := b.created[name]; ok {
+		return pattern
+	}
+	patternConfig, ok := b.configs[name]
+	if !ok {
+		return nil
+	}
+	if pattern := b.reuse[name]; pattern != nil {
+		b.created[name] = pattern
+		return pattern
+	}
+	b.created[name] = nil // break cycles, checked in config
+	var pattern Pattern
+	if len(patternConfig.Provider) > 0 {
+		pattern = newProviderPattern(name, patternConfig, b.providers, b.edits[name])
+	} else {
+		config, removed := b.edits[name].config(patternConfig)
+		if pattern = CreatePattern(name, config); pattern != nil {
+			for _, val := range removed {
+				pattern.Remove(val)
+			}
+		}
+	}
+	if lp, ok := pattern.(*LogicalPattern); ok {
+		for _, child := range lp.names {
+			if p := b.create(child); p != nil {
+				lp.addChild(p)
+			}
+		}
+	}
+	b.created[name] = pattern
+	return pattern
+}
+
+func newRule(config RuleConfig, b *patternBuilder, direct []string) *Rule {
 	rule := new(Rule)
 	rule.final = config.Final
-	pattern := NewDomainSuffixPattern("__internal__", DIRECT_POLICY, "", nil)
+	rule.config = config
+	rule.configs = b.configs
+	rule.providers = b.providers
+	rule.edits = b.edits
+	rule.direct = direct
+	pattern := NewDomainSuffixPattern("__internal__", DIRECT_POLICY, "", direct)
 	rule.patterns = append(rule.patterns, pattern)
+
 	for _, name := range config.Pattern {
-		if patternConfig, ok := patterns[name]; ok {
-			if pattern := CreatePattern(name, patternConfig); pattern != nil {
-				rule.patterns = append(rule.patterns, pattern)
-			}
+		if pattern := b.create(name); pattern != nil {
+			rule.patterns = append(rule.patterns, pattern)
+			rule.hasFlow = rule.hasFlow || isFlowPattern(pattern)
+			rule.hasSource = rule.hasSource || isSourceScheme(pattern.Scheme())
 		}
 	}
+	rule.created = b.created
 	return rule
 }
+
+func NewRule(config RuleConfig, patterns map[string]*PatternConfig, providers *Providers) *Rule {
+	return newRule(config, newPatternBuilder(patterns, providers), nil)
+}
+
+// next rule sharing unchanged patterns, pattern `changed` and logical patterns are created again
+func (rule *Rule) next(edits map[string]*PatternEdit, direct []string, changed string) *Rule {
+	b := newPatternBuilder(rule.configs, rule.providers)
+	b.edits = edits
+	b.reuse = make(map[string]Pattern)
+	for name, pattern := range rule.created {
+		if _, ok := pattern.(*LogicalPattern); !ok && name != changed {
+			b.reuse[name] = pattern
+		}
+	}
+	return newRule(rule.config, b, direct)
+}
+
+// patterns of rule including the ones only referred by logical patterns
+func (rule *Rule) Pattern(name string) Pattern {
+	return rule.created[name]
+}
+
+func (rule *Rule) Edits() map[string]*PatternEdit {
+	return rule.edits
+}
+
+// rule in use, rules are never changed once in use. edits and reloads create
+// a new rule and swap it in, connections and queries keep the rule they loaded
+type RuleSet struct {
+	lock    sync.Mutex   // serialize changes
+	current atomic.Value // *Rule
+	overlay *RuleOverlay // edits through api
+}
+
+func (rs *RuleSet) Load() *Rule {
+	return rs.current.Load().(*Rule)
+}
+
+// provider patterns dropped by the new rule stop receiving updates
+func (rs *RuleSet) swap(next *Rule) {
+	last, _ := rs.current.Load().(*Rule)
+	rs.current.Store(next)
+	if last == nil {
+		return
+	}
+	for name, pattern := range last.created {
+		if pp, ok := pattern.(*ProviderPattern); ok && next.created[name] != pattern {
+			pp.close()
+		}
+	}
+}
+
+// domain never hijacked, eg: host of proxy server
+func (rs *RuleSet) DirectDomain(domain string) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	logger.Debugf("[rule] add direct domain: %s", domain)
+	rule := rs.Load()
+	direct := append(append([]string(nil), rule.direct...), domain)
+	rs.swap(rule.next(rule.edits, direct, ""))
+}
+
+// record the edit, then swap in the rule with it
+func (rs *RuleSet) change(e *RuleEditLog) error {
+	rule := rs.Load()
+	edits := e.apply(rule.edits)
+	next := rule.next(edits, rule.direct, e.Pattern)
+	if err := rs.overlay.Append(e); err != nil {
+		return fmt.Errorf("save edit failed: %v", err)
+	}
+	rs.swap(next)
+	logger.Infof("[rule] %s %s pattern %s: %s", e.User, e.Action, e.Pattern, e.Value)
+	return nil
+}
+
+// add or remove a value of pattern by user of manager
+func (rs *RuleSet) Edit(user, name, val string, add bool) error {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	pattern := rs.Load().created[name]
+	if pattern == nil {
+		return fmt.Errorf("no pattern: %s", name)
+	}
+	if isLogicalScheme(pattern.Scheme()) {
+		return fmt.Errorf("pattern %s has no values", name)
+	}
+
+	action := ruleEditRemove
+	if add {
+		action = ruleEditAdd
+	}
+	return rs.change(&RuleEditLog{Time: time.Now(), User: user, Action: action, Pattern: name, Value: val})
+}
+
+// drop edits of a value, or all edits of pattern if val is empty
+func (rs *RuleSet) Revert(user, name, val string) error {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	edit := rs.Load().edits[name]
+	if edit == nil || val != "" && !edit.Added[val] && !edit.Removed[val] {
+		return fmt.Errorf("no edits of pattern %s: %s", name, val)
+	}
+	return rs.change(&RuleEditLog{Time: time.Now(), User: user, Action: ruleEditRevert, Pattern: name, Value: val})
+}
+
+func (rs *RuleSet) History() []*RuleEditLog {
+	return rs.overlay.History()
+}
+
+// edits in use against config
+func (rs *RuleSet) Diff() string {
+	return formatRuleDiff(rs.Load().edits)
+}
+
+// new [pattern] and [rule] sections, edits through api are kept
+func (rs *RuleSet) Reload(config RuleConfig, patterns map[string]*PatternConfig) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rule := rs.Load()
+	b := newPatternBuilder(patterns, rule.providers)
+	b.edits = rule.edits
+	rs.swap(newRule(config, b, rule.direct))
+	logger.Infof("[rule] reload %d patterns", len(config.Pattern))
+}
+
+// edits in overlay file are replayed
+func NewRuleSet(config RuleConfig, patterns map[string]*PatternConfig, providers *Providers) *RuleSet {
+	rs := new(RuleSet)
+	rs.overlay = NewRuleOverlay(config.Overlay)
+	b := newPatternBuilder(patterns, providers)
+	b.edits = rs.overlay.Edits()
+	rs.swap(newRule(config, b, nil))
+	return rs
+}
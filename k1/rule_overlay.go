@@ -0,0 +1,182 @@
+package k1
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// actions of rule edits through api
+const (
+	ruleEditAdd    = "add"
+	ruleEditRemove = "remove"
+	ruleEditRevert = "revert" // drop edits of value, or all edits of pattern if value is empty
+)
+
+type RuleEditLog struct {
+	Time    time.Time
+	User    string // manager session user
+	Action  string
+	Pattern string
+	Value   string
+}
+
+// edits after the entry, edits in use are copied and never changed
+func (e *RuleEditLog) apply(edits map[string]*PatternEdit) map[string]*PatternEdit {
+	next := make(map[string]*PatternEdit, len(edits)+1)
+	for name, edit := range edits {
+		next[name] = edit
+	}
+
+	edit := edits[e.Pattern].clone()
+	switch e.Action {
+	case ruleEditAdd:
+		delete(edit.Removed, e.Value)
+		edit.Added[e.Value] = true
+	case ruleEditRemove:
+		delete(edit.Added, e.Value)
+		edit.Removed[e.Value] = true
+	case ruleEditRevert:
+		if e.Value == "" {
+			edit = nil
+		} else {
+			delete(edit.Added, e.Value)
+			delete(edit.Removed, e.Value)
+		}
+	}
+	if edit == nil || len(edit.Added) == 0 && len(edit.Removed) == 0 {
+		delete(next, e.Pattern)
+	} else {
+		next[e.Pattern] = edit
+	}
+	return next
+}
+
+// history of rule edits, appended to file as json lines and replayed on start
+type RuleOverlay struct {
+	lock    sync.Mutex
+	file    string // kept in memory only if empty
+	partial bool   // file doesn't end with a new line
+	history []*RuleEditLog
+}
+
+func (o *RuleOverlay) load() error {
+	data, err := ioutil.ReadFile(o.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// end the partial line written on crash before appending
+	o.partial = len(data) > 0 && data[len(data)-1] != '\n'
+
+	for i, line := range bytes.Split(data, []byte{'\n'}) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		e := new(RuleEditLog)
+		if err := jsoniter.Unmarshal(line, e); err != nil {
+			logger.Errorf("[rule] %s:%d: %v", o.file, i+1, err)
+			continue
+		}
+		o.history = append(o.history, e)
+	}
+	return nil
+}
+
+func (o *RuleOverlay) Append(e *RuleEditLog) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.file != "" {
+		data, err := jsoniter.Marshal(e)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(o.file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		if o.partial {
+			data = append([]byte{'\n'}, data...)
+		}
+		if _, err = f.Write(append(data, '\n')); err == nil {
+			o.partial = false
+			err = f.Sync()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	o.history = append(o.history, e)
+	return nil
+}
+
+// oldest first
+func (o *RuleOverlay) History() []*RuleEditLog {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.history
+}
+
+// edits of all entries
+func (o *RuleOverlay) Edits() map[string]*PatternEdit {
+	var edits map[string]*PatternEdit
+	for _, e := range o.History() {
+		edits = e.apply(edits)
+	}
+	return edits
+}
+
+func NewRuleOverlay(file string) *RuleOverlay {
+	o := &RuleOverlay{file: file}
+	if file != "" {
+		if err := o.load(); err != nil {
+			logger.Errorf("[rule] load overlay failed: %v", err)
+		}
+		logger.Infof("[rule] %d edits in overlay %s", len(o.history), file)
+	}
+	return o
+}
+
+// edits against [pattern] sections of config, eg:
+//
+//	[pattern "proxy-website-suffix"]
+//	+v = example.com
+//	-v = example.net
+func formatRuleDiff(edits map[string]*PatternEdit) string {
+	var names []string
+	for name := range edits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sorted := func(vals map[string]bool) []string {
+		var s []string
+		for val := range vals {
+			s = append(s, val)
+		}
+		sort.Strings(s)
+		return s
+	}
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "[pattern %q]\n", name)
+		for _, val := range sorted(edits[name].Added) {
+			fmt.Fprintf(&buf, "+v = %s\n", val)
+		}
+		for _, val := range sorted(edits[name].Removed) {
+			fmt.Fprintf(&buf, "-v = %s\n", val)
+		}
+	}
+	return buf.String()
+}
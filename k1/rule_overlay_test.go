@@ -0,0 +1,87 @@
+package k1
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRuleOverlay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	patterns := map[string]*PatternConfig{
+		"suffix": {Policy: PROXY_POLICY, Proxy: "A", Scheme: schemeDomainSuffix, V: []string{"google.com"}},
+		"lan":    {Policy: PROXY_POLICY, Proxy: "B", Scheme: schemeIPCIDR, V: []string{"192.168.0.0/16"}},
+	}
+	config := RuleConfig{Pattern: []string{"suffix", "lan"}, Overlay: filepath.Join(dir, "overlay.json")}
+
+	rs := NewRuleSet(config, patterns, nil)
+	rs.Edit("alice", "suffix", "example.com", true)
+	rs.Edit("alice", "suffix", "example.net", true)
+	rs.Edit("bob", "suffix", "google.com", false)
+	rs.Edit("bob", "lan", "10.0.0.0/8", true)
+
+	expected := "[pattern \"lan\"]\n+v = 10.0.0.0/8\n" +
+		"[pattern \"suffix\"]\n+v = example.com\n+v = example.net\n-v = google.com\n"
+	if diff := rs.Diff(); diff != expected {
+		t.Errorf("diff:\n%s", diff)
+	}
+
+	if err := rs.Revert("carol", "suffix", "unknown.com"); err == nil {
+		t.Error("revert value not edited")
+	}
+	if err := rs.Revert("carol", "suffix", "example.net"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.Revert("carol", "lan", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	history := rs.History()
+	if len(history) != 6 {
+		t.Fatalf("history: %d", len(history))
+	}
+	if e := history[2]; e.User != "bob" || e.Action != ruleEditRemove || e.Pattern != "suffix" || e.Value != "google.com" || e.Time.IsZero() {
+		t.Errorf("history: %+v", e)
+	}
+
+	// a partial line on crash is skipped
+	f, _ := os.OpenFile(config.Overlay, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte(`{"Time":"2020-`))
+	f.Close()
+
+	// edits are replayed on start
+	rs = NewRuleSet(config, patterns, nil)
+	rule := rs.Load()
+	for val, expected := range map[string]string{
+		"example.com": "A",
+		"example.net": "",
+		"google.com":  "",
+	} {
+		if _, proxy := rule.Proxy(val); proxy != expected {
+			t.Errorf("%v: proxy %q, expected %q", val, proxy, expected)
+		}
+	}
+	if matched, _ := rule.Proxy(net.ParseIP("10.1.1.1")); matched {
+		t.Error("reverted pattern should not be matched")
+	}
+	if len(rs.History()) != 6 {
+		t.Errorf("history after restart: %d", len(rs.History()))
+	}
+	if diff := rs.Diff(); diff != "[pattern \"suffix\"]\n+v = example.com\n-v = google.com\n" {
+		t.Errorf("diff after restart:\n%s", diff)
+	}
+
+	// appended after the partial line
+	rs.Revert("carol", "suffix", "")
+	rs = NewRuleSet(config, patterns, nil)
+	if len(rs.History()) != 7 || rs.Diff() != "" {
+		t.Errorf("history after revert: %d, diff: %s", len(rs.History()), rs.Diff())
+	}
+}
@@ -0,0 +1,187 @@
+package k1
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestRuleSetEdit(t *testing.T) {
+	patterns := map[string]*PatternConfig{
+		"google": {Policy: PROXY_POLICY, Proxy: "A", Scheme: schemeDomainSuffix, V: []string{"google.com"}},
+		"lan":    {Policy: DIRECT_POLICY, Scheme: schemeIPCIDR, V: []string{"192.168.0.0/16"}},
+		"udp":    {Scheme: schemeNetwork, V: []string{"udp"}},
+		"quic":   {Policy: REJECT_POLICY, Scheme: schemeAnd, V: []string{"google", "udp"}},
+	}
+	rs := NewRuleSet(RuleConfig{Pattern: []string{"quic", "google", "lan"}, Final: "B"}, patterns, nil)
+	first := rs.Load()
+
+	if err := rs.Edit("admin", "google", "youtube.com", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.Edit("admin", "unknown", "youtube.com", true); err == nil {
+		t.Error("edit unknown pattern")
+	}
+	if err := rs.Edit("admin", "quic", "udp", true); err == nil {
+		t.Error("edit logical pattern")
+	}
+	second := rs.Load()
+
+	// rule in use is never changed
+	if matched, _ := first.Proxy("www.youtube.com"); matched {
+		t.Error("last rule should not be changed")
+	}
+	if matched, proxy := second.Proxy("www.youtube.com"); !matched || proxy != "A" {
+		t.Error("new rule should match added value")
+	}
+	if first.Pattern("lan") != second.Pattern("lan") || first.Pattern("google") == second.Pattern("google") {
+		t.Error("only the edited pattern is created again")
+	}
+	if _, reject := second.ProxyFlow(&Flow{Network: "udp", Host: "www.youtube.com"}, "A"); !reject {
+		t.Error("logical pattern should refer to the edited pattern")
+	}
+
+	rs.Edit("admin", "google", "google.com", false)
+	rs.DirectDomain("proxy.google.com")
+	third := rs.Load()
+	if matched, _ := third.Proxy("www.google.com"); matched {
+		t.Error("removed value should not be matched")
+	}
+	if matched, proxy := third.Proxy("proxy.google.com"); !matched || proxy != "" {
+		t.Error("direct domain should be matched first")
+	}
+	if matched, _ := third.Proxy("www.youtube.com"); !matched {
+		t.Error("edits should be kept")
+	}
+	if edit := third.Edits()["google"]; !edit.Added["youtube.com"] || !edit.Removed["google.com"] {
+		t.Errorf("edits: %+v", edit)
+	}
+}
+
+func TestRuleSetReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	localFile := filepath.Join(dir, "local.txt")
+	ioutil.WriteFile(localFile, []byte("example.com\n"), 0644)
+	ps := NewProviders(map[string]*ProviderConfig{"local": {Url: localFile, Format: providerFormatDomain}})
+
+	patterns := map[string]*PatternConfig{
+		"local": {Policy: PROXY_POLICY, Proxy: "A", Scheme: schemeDomainSuffix, Provider: []string{"local"}},
+	}
+	rs := NewRuleSet(RuleConfig{Pattern: []string{"local"}}, patterns, ps)
+	rs.Edit("admin", "local", "added.com", true)
+	if len(ps.Get("local").patterns) != 1 {
+		t.Fatal("replaced provider pattern should be unsubscribed")
+	}
+
+	patterns = map[string]*PatternConfig{
+		"local": {Policy: PROXY_POLICY, Proxy: "B", Scheme: schemeDomainSuffix, Provider: []string{"local"}},
+		"lan":   {Policy: PROXY_POLICY, Proxy: "C", Scheme: schemeIPCIDR, V: []string{"192.168.0.0/16"}},
+	}
+	rs.Reload(RuleConfig{Pattern: []string{"lan", "local"}}, patterns)
+	rule := rs.Load()
+	if _, proxy := rule.Proxy("www.example.com"); proxy != "B" {
+		t.Errorf("proxy of reloaded pattern: %q", proxy)
+	}
+	if _, proxy := rule.Proxy("added.com"); proxy != "B" {
+		t.Error("edits should be kept on reload")
+	}
+	if _, proxy := rule.Proxy(net.ParseIP("192.168.1.1")); proxy != "C" {
+		t.Error("new pattern should be loaded")
+	}
+	if len(ps.Get("local").patterns) != 1 {
+		t.Fatal("provider patterns of the last rule should be unsubscribed")
+	}
+}
+
+func TestRuleSetReplayEdits(t *testing.T) {
+	patterns := map[string]*PatternConfig{
+		"keyword": {Policy: PROXY_POLICY, Proxy: "A", Scheme: schemeDomainKeyword, V: []string{"Google", "facebook"}},
+	}
+	edits := map[string]*PatternEdit{
+		"keyword": {Added: make(map[string]bool), Removed: map[string]bool{"google": true}},
+	}
+	for i := 0; i < 5000; i++ {
+		edits["keyword"].Added[fmt.Sprintf("tracker%d", i)] = true
+	}
+	config, removed := edits["keyword"].config(patterns["keyword"])
+	if len(config.V) != 5001 || config.V[0] != "facebook" || len(patterns["keyword"].V) != 2 || len(removed) != 0 {
+		t.Fatalf("config with edits: %d values", len(config.V))
+	}
+
+	// edits are built into the pattern once, not added one by one
+	b := newPatternBuilder(patterns, nil)
+	b.edits = edits
+	rule := newRule(RuleConfig{Pattern: []string{"keyword"}}, b, nil)
+	for val, expected := range map[string]bool{
+		"www.tracker4999.com": true,
+		"www.facebook.com":    true,
+		"www.google.com":      false,
+		"www.tracker.com":     false,
+	} {
+		if matched, _ := rule.Proxy(val); matched != expected {
+			t.Errorf("%s: matched %v, expected %v", val, matched, expected)
+		}
+	}
+}
+
+func TestRuleSetRemoveSplitCIDR(t *testing.T) {
+	patterns := map[string]*PatternConfig{
+		"cidr": {Policy: PROXY_POLICY, Proxy: "A", Scheme: schemeIPCIDR, V: []string{"10.0.0.0/8"}},
+	}
+	rs := NewRuleSet(RuleConfig{Pattern: []string{"cidr"}}, patterns, nil)
+	if err := rs.Edit("admin", "cidr", "10.1.0.0/16", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// removed the same as Pattern.Remove
+	rule := rs.Load()
+	if matched, _ := rule.Proxy(net.ParseIP("10.1.2.3")); matched {
+		t.Error("removed cidr inside configured one should not be matched")
+	}
+	if matched, _ := rule.Proxy(net.ParseIP("10.2.2.3")); !matched {
+		t.Error("rest of configured cidr should be matched")
+	}
+}
+
+// run with -race
+func TestRuleSetConcurrent(t *testing.T) {
+	patterns := map[string]*PatternConfig{
+		"suffix": {Policy: PROXY_POLICY, Proxy: "A", Scheme: schemeDomainSuffix, V: []string{"google.com"}},
+		"cidr":   {Policy: PROXY_POLICY, Proxy: "A", Scheme: schemeIPCIDR, V: []string{"10.0.0.0/8"}},
+	}
+	rs := NewRuleSet(RuleConfig{Pattern: []string{"suffix", "cidr"}}, patterns, nil)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				rule := rs.Load()
+				rule.Proxy("www.example0.com")
+				rule.Proxy(net.ParseIP("10.1.2.3"))
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		rs.Edit("admin", "suffix", fmt.Sprintf("example%d.com", i%10), i%3 != 0)
+		rs.Edit("admin", "cidr", fmt.Sprintf("172.16.%d.0/24", i%10), i%3 != 0)
+	}
+	close(done)
+	wg.Wait()
+}
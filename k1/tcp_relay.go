@@ -19,6 +19,7 @@ type TCPRelay struct {
 	nat       *Nat
 	relayIP   net.IP
 	relayPort uint16
+	dnsNat    *Nat // intercepted dns queries
 }
 
 func copy(src net.Conn, dst net.Conn, ch chan<- int64) {
@@ -45,16 +46,36 @@ func (r *TCPRelay) realRemoteHost(conn net.Conn, connData *ConnData) (addr strin
 	}
 
 	one := r.one
+	rule := one.rules.Load()
 
 	var host string
+	flow := &Flow{Network: "tcp", SrcIP: session.srcIP, DstPort: session.dstPort}
+	flow.Owner = func() *Process { return session.Process(flow.Network) }
 	if record := one.dnsTable.GetByIP(session.dstIP); record != nil {
 		host = record.Hostname
 		proxy = record.Proxy
+		flow.Host = host
+		flow.DstIP = one.dnsTable.RealIP(record)
 	} else if one.dnsTable.Contains(session.dstIP) {
 		logger.Debugf("[tcp] %s:%d > %s:%d dns expired", session.srcIP, session.srcPort, session.dstIP, session.dstPort)
 		return
 	} else {
+		// real ip, route by ip patterns, default proxy if none matches
+		if rule.Reject(session.dstIP) {
+			logger.Debugf("[tcp] %s:%d > %s:%d reject", session.srcIP, session.srcPort, session.dstIP, session.dstPort)
+			return
+		}
 		host = session.dstIP.String()
+		if matched, matchedProxy := rule.Proxy(session.dstIP); matched {
+			proxy = matchedProxy
+		}
+		flow.DstIP = session.dstIP
+	}
+
+	proxy, reject := rule.ProxyFlow(flow, proxy)
+	if reject {
+		logger.Debugf("[tcp] %v reject", flow)
+		return "", proxy
 	}
 
 	connData.Src = session.srcIP.String()
@@ -127,6 +148,10 @@ func (r *TCPRelay) Serve() error {
 	}
 }
 
+func (r *TCPRelay) dnsSession(ip net.IP, port uint16) *NatSession {
+	return r.dnsNat.lookupSession(ip, port)
+}
+
 // redirect tcp packet to relay
 func (r *TCPRelay) Filter(wr io.Writer, ipPacket tcpip.IPv4Packet) {
 	tcpPacket := tcpip.TCPPacket(ipPacket.Payload())
@@ -148,6 +173,31 @@ func (r *TCPRelay) Filter(wr io.Writer, ipPacket tcpip.IPv4Packet) {
 		ipPacket.SetDestinationIP(session.srcIP)
 		tcpPacket.SetSourcePort(session.dstPort)
 		tcpPacket.SetDestinationPort(session.srcPort)
+	} else if dns := r.one.dns; dns.intercept && r.relayIP.Equal(srcIP) && srcPort == dns.port {
+		// dns answer of intercepted query
+		session := r.dnsNat.getSession(dstPort)
+		if session == nil {
+			logger.Debugf("[tcp] %s:%d > %s:%d: no dns session", srcIP, srcPort, dstIP, dstPort)
+			return
+		}
+
+		ipPacket.SetSourceIP(session.dstIP)
+		ipPacket.SetDestinationIP(session.srcIP)
+		tcpPacket.SetSourcePort(session.dstPort)
+		tcpPacket.SetDestinationPort(session.srcPort)
+	} else if dns.intercept && dstPort == dnsDefaultPort && !r.relayIP.Equal(srcIP) {
+		// redirect dns query to dns server, upstream queries of kone itself are relayed
+		isNew, port := r.dnsNat.allocSession(srcIP, dstIP, srcPort, dstPort)
+
+		ipPacket.SetSourceIP(dstIP)
+		tcpPacket.SetSourcePort(port)
+		ipPacket.SetDestinationIP(r.relayIP)
+		tcpPacket.SetDestinationPort(dns.port)
+
+		if isNew {
+			logger.Debugf("[tcp] %s:%d > %s:%d: intercept dns to %s:%d > %s:%d",
+				srcIP, srcPort, dstIP, dstPort, dstIP, port, r.relayIP, dns.port)
+		}
 	} else {
 		// redirect to relay
 		isNew, port := r.nat.allocSession(srcIP, dstIP, srcPort, dstPort)
@@ -173,6 +223,7 @@ func NewTCPRelay(one *One, cfg NatConfig) *TCPRelay {
 	relay := new(TCPRelay)
 	relay.one = one
 	relay.nat = NewNat(cfg.NatPortStart, cfg.NatPortEnd)
+	relay.dnsNat = NewNat(cfg.NatPortStart, cfg.NatPortEnd)
 	relay.relayIP = one.ip
 	relay.relayPort = cfg.ListenPort
 	return relay
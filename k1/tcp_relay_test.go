@@ -0,0 +1,105 @@
+package k1
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/nxsre/kone/tcpip"
+)
+
+// ipv4 packet with tcp or udp header and no payload
+func testIPv4Packet(protocol tcpip.IPProtocol, src, dst net.IP, srcPort, dstPort uint16) tcpip.IPv4Packet {
+	size := 20
+	if protocol == tcpip.UDP {
+		size = 8
+	}
+	b := make([]byte, 20+size)
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	b[8] = 64
+	b[9] = byte(protocol)
+	binary.BigEndian.PutUint16(b[20:], srcPort)
+	binary.BigEndian.PutUint16(b[22:], dstPort)
+	if protocol == tcpip.TCP {
+		b[32] = 5 << 4
+	} else {
+		binary.BigEndian.PutUint16(b[24:], uint16(size))
+	}
+	packet := tcpip.IPv4Packet(b)
+	packet.SetSourceIP(src)
+	packet.SetDestinationIP(dst)
+	return packet
+}
+
+func testRelayOne() *One {
+	ip, subnet, _ := net.ParseCIDR("10.192.0.1/16")
+	one := &One{ip: ip.To4(), subnet: subnet}
+	one.dns = &Dns{intercept: true, port: 5353}
+	one.dnsTable = NewDnsTable(one.ip, subnet, DnsConfig{})
+	return one
+}
+
+func TestTCPRelayInterceptDns(t *testing.T) {
+	one := testRelayOne()
+	relay := NewTCPRelay(one, NatConfig{ListenPort: 82, NatPortStart: 10000, NatPortEnd: 10100})
+	nameserver := net.ParseIP("8.8.8.8")
+
+	// query of client is redirected to dns server
+	var buf bytes.Buffer
+	relay.Filter(&buf, testIPv4Packet(tcpip.TCP, net.ParseIP("192.168.1.2"), nameserver, 40000, 53))
+	packet := tcpip.IPv4Packet(buf.Bytes())
+	if port := tcpip.TCPPacket(packet.Payload()).DestinationPort(); !packet.DestinationIP().Equal(one.ip) || port != 5353 {
+		t.Errorf("query of client: %s:%d", packet.DestinationIP(), port)
+	}
+
+	// upstream query of kone is relayed, not looped back
+	buf.Reset()
+	relay.Filter(&buf, testIPv4Packet(tcpip.TCP, one.ip, nameserver, 40001, 53))
+	packet = tcpip.IPv4Packet(buf.Bytes())
+	if port := tcpip.TCPPacket(packet.Payload()).DestinationPort(); port != 82 {
+		t.Errorf("upstream query: %s:%d", packet.DestinationIP(), port)
+	}
+	if relay.dnsNat.count() != 1 {
+		t.Errorf("dns sessions: %d", relay.dnsNat.count())
+	}
+}
+
+// conn accepted by relay from a nat port
+type testRelayConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *testRelayConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestTCPRelayRealIP(t *testing.T) {
+	one := testRelayOne()
+	patterns := map[string]*PatternConfig{
+		"blocked": {Policy: REJECT_POLICY, Scheme: schemeIPCIDR, V: []string{"1.2.3.0/24"}},
+		"lan":     {Policy: PROXY_POLICY, Proxy: "B", Scheme: schemeIPCIDR, V: []string{"192.168.0.0/16"}},
+	}
+	one.rules = NewRuleSet(RuleConfig{Pattern: []string{"blocked", "lan"}, Final: "F"}, patterns, nil)
+	relay := NewTCPRelay(one, NatConfig{ListenPort: 82, NatPortStart: 10000, NatPortEnd: 10100})
+
+	cases := []struct {
+		dst   string
+		addr  string
+		proxy string
+	}{
+		{"1.2.3.4", "", ""},
+		{"192.168.1.5", "192.168.1.5:443", "B"},
+		{"8.8.4.4", "8.8.4.4:443", ""}, // default proxy, not final
+	}
+	for i, c := range cases {
+		_, port := relay.nat.allocSession(net.ParseIP("192.168.1.2").To4(), net.ParseIP(c.dst).To4(), uint16(40000+i), 443)
+		conn := &testRelayConn{remote: &net.TCPAddr{IP: one.ip, Port: int(port)}}
+		var connData ConnData
+		if addr, proxy := relay.realRemoteHost(conn, &connData); addr != c.addr || proxy != c.proxy {
+			t.Errorf("%s: addr %q proxy %q, expected %q %q", c.dst, addr, proxy, c.addr, c.proxy)
+		}
+	}
+}
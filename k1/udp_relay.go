@@ -82,86 +82,139 @@ type UDPRelay struct {
 	nat       *Nat
 	relayIP   net.IP
 	relayPort uint16
+	dnsNat    *Nat // intercepted dns queries
 
 	lock    sync.Mutex
 	tunnels map[string]*UDPTunnel
+	dialing map[string]chan struct{} // closed once tunnel of client is dialed
 }
 
-func (r *UDPRelay) grabTunnel(localConn *net.UDPConn, clientAddr *net.UDPAddr) *UDPTunnel {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-	addr := clientAddr.String()
-	tunnel := r.tunnels[addr]
-	if tunnel == nil {
-		port := uint16(clientAddr.Port)
-		session := r.nat.getSession(port)
-		if session == nil {
-			logger.Errorf("[udp] %s:%d > %s:%d no session", session.srcIP, session.srcPort, session.dstIP, session.dstPort)
-			return nil
-		}
+// tunnel of client decided by rule and dialed by proxy. owner process is
+// resolved and proxy dialed without r.lock, tunnels of other clients aren't blocked
+func (r *UDPRelay) dialTunnel(localConn *net.UDPConn, clientAddr *net.UDPAddr) *UDPTunnel {
+	port := uint16(clientAddr.Port)
+	session := r.nat.getSession(port)
+	if session == nil {
+		logger.Errorf("[udp] %v no session", clientAddr)
+		return nil
+	}
 
-		one := r.one
-		var host, proxy string
-		if record := one.dnsTable.GetByIP(session.dstIP); record != nil {
-			host = record.Hostname
-			proxy = record.Proxy
-		} else if one.dnsTable.Contains(session.dstIP) {
-			logger.Debugf("[udp] %s:%d > %s:%d dns expired", session.srcIP, session.srcPort, session.dstIP, session.dstPort)
+	one := r.one
+	rule := one.rules.Load()
+	var host, proxy string
+	flow := &Flow{Network: "udp", SrcIP: session.srcIP, DstPort: session.dstPort}
+	flow.Owner = func() *Process { return session.Process(flow.Network) }
+	if record := one.dnsTable.GetByIP(session.dstIP); record != nil {
+		host = record.Hostname
+		proxy = record.Proxy
+		flow.Host = host
+		flow.DstIP = one.dnsTable.RealIP(record)
+	} else if one.dnsTable.Contains(session.dstIP) {
+		logger.Debugf("[udp] %s:%d > %s:%d dns expired", session.srcIP, session.srcPort, session.dstIP, session.dstPort)
+		return nil
+	} else {
+		// real ip, route by ip patterns, default proxy if none matches
+		if rule.Reject(session.dstIP) {
+			logger.Debugf("[udp] %s:%d > %s:%d reject", session.srcIP, session.srcPort, session.dstIP, session.dstPort)
 			return nil
-		} else {
-			host = session.dstIP.String()
 		}
-		remoteAddr := fmt.Sprintf("%s:%d", host, session.dstPort)
-		logger.Debugf("[udp] %s:%d > %s proxy %q", session.srcIP, session.srcPort, remoteAddr, proxy)
-		if remoteAddr == "" {
-			return nil
+		host = session.dstIP.String()
+		if matched, matchedProxy := rule.Proxy(session.dstIP); matched {
+			proxy = matchedProxy
 		}
+		flow.DstIP = session.dstIP
+	}
 
-		proxies := one.proxies
-		socks5TCPConn, err := proxies.Dial("udp", proxy, remoteAddr)
-		if err != nil {
-			logger.Errorf("[udp] dial %s by proxy %q failed: %s", remoteAddr, proxy, err)
-			return nil
-		}
+	proxy, reject := rule.ProxyFlow(flow, proxy)
+	if reject {
+		logger.Debugf("[udp] %v reject", flow)
+		return nil
+	}
+	remoteAddr := fmt.Sprintf("%s:%d", host, session.dstPort)
+	logger.Debugf("[udp] %s:%d > %s proxy %q", session.srcIP, session.srcPort, remoteAddr, proxy)
+	if remoteAddr == "" {
+		return nil
+	}
+
+	proxies := one.proxies
+	socks5TCPConn, err := proxies.Dial("udp", proxy, remoteAddr)
+	if err != nil {
+		logger.Errorf("[udp] dial %s by proxy %q failed: %s", remoteAddr, proxy, err)
+		return nil
+	}
 
-		socks5UDPListen, socks5Reply, err := socks5Proxy.Socks5UDPRequest(socks5TCPConn, "0.0.0.0", 0)
+	socks5UDPListen, socks5Reply, err := socks5Proxy.Socks5UDPRequest(socks5TCPConn, "0.0.0.0", 0)
 
-		var hostType byte
-		if ip := net.ParseIP(host); ip != nil {
-			if ip4 := ip.To4(); ip4 != nil {
-				hostType = socks5Proxy.Socks5AtypIP4
-			} else {
-				hostType = socks5Proxy.Socks5AtypIP6
-			}
+	var hostType byte
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			hostType = socks5Proxy.Socks5AtypIP4
 		} else {
-			hostType = socks5Proxy.Socks5AtypDomain
+			hostType = socks5Proxy.Socks5AtypIP6
 		}
+	} else {
+		hostType = socks5Proxy.Socks5AtypDomain
+	}
+
+	tunnel := &UDPTunnel{
+		session:        session,
+		clientAddr:     clientAddr,
+		localConn:      localConn,
+		remoteUDPConn:  socks5UDPListen,
+		remoteTCPConn:  socks5TCPConn,
+		remoteHostType: hostType,
+		remoteHost:     host,
+		remotePort:     session.dstPort,
+		BndHost:        socks5Reply.BndHost,
+		BndPort:        socks5Reply.BndPort,
+	}
 
-		tunnel = &UDPTunnel{
-			session:        session,
-			clientAddr:     clientAddr,
-			localConn:      localConn,
-			remoteUDPConn:  socks5UDPListen,
-			remoteTCPConn:  socks5TCPConn,
-			remoteHostType: hostType,
-			remoteHost:     host,
-			remotePort:     session.dstPort,
-			BndHost:        socks5Reply.BndHost,
-			BndPort:        socks5Reply.BndPort,
+	logger.Debugf("[udp] %s:%d > %v: new tunnel", session.srcIP, session.srcPort, remoteAddr)
+	return tunnel
+}
+
+func (r *UDPRelay) grabTunnel(localConn *net.UDPConn, clientAddr *net.UDPAddr) *UDPTunnel {
+	addr := clientAddr.String()
+	for {
+		r.lock.Lock()
+		if tunnel := r.tunnels[addr]; tunnel != nil {
+			r.lock.Unlock()
+			tunnel.SetDeadline(NatSessionLifeSeconds * time.Second)
+			return tunnel
 		}
+		// packets of client wait for the tunnel being dialed
+		wait, ok := r.dialing[addr]
+		if !ok {
+			break
+		}
+		r.lock.Unlock()
+		<-wait
+	}
+	done := make(chan struct{})
+	r.dialing[addr] = done
+	r.lock.Unlock()
 
-		logger.Debugf("[udp] %s:%d > %v: new tunnel", session.srcIP, session.srcPort, remoteAddr)
+	tunnel := r.dialTunnel(localConn, clientAddr)
 
+	r.lock.Lock()
+	delete(r.dialing, addr)
+	if tunnel != nil {
 		r.tunnels[addr] = tunnel
-		go func() {
-			err := tunnel.Pump()
-			if err != nil {
-				logger.Errorf("[udp] pump to %v failed: %v", tunnel.remoteUDPConn.RemoteAddr(), err)
-			}
-			logger.Debugf("[udp] %s:%d > %v: destroy tunnel", tunnel.session.srcIP, tunnel.session.srcPort, remoteAddr)
-			r.close(tunnel, addr)
-		}()
 	}
+	r.lock.Unlock()
+	close(done)
+	if tunnel == nil {
+		return nil
+	}
+
+	go func() {
+		err := tunnel.Pump()
+		if err != nil {
+			logger.Errorf("[udp] pump to %v failed: %v", tunnel.remoteUDPConn.RemoteAddr(), err)
+		}
+		logger.Debugf("[udp] %s:%d > %s:%d: destroy tunnel", tunnel.session.srcIP, tunnel.session.srcPort, tunnel.remoteHost, tunnel.remotePort)
+		r.close(tunnel, addr)
+	}()
 	tunnel.SetDeadline(NatSessionLifeSeconds * time.Second)
 	return tunnel
 }
@@ -204,6 +257,10 @@ func (r *UDPRelay) Serve() error {
 	}
 }
 
+func (r *UDPRelay) dnsSession(ip net.IP, port uint16) *NatSession {
+	return r.dnsNat.lookupSession(ip, port)
+}
+
 // redirect udp packet to relay
 func (r *UDPRelay) Filter(wr io.Writer, ipPacket tcpip.IPv4Packet) {
 	udpPacket := tcpip.UDPPacket(ipPacket.Payload())
@@ -226,6 +283,30 @@ func (r *UDPRelay) Filter(wr io.Writer, ipPacket tcpip.IPv4Packet) {
 		ipPacket.SetDestinationIP(session.srcIP)
 		udpPacket.SetSourcePort(session.dstPort)
 		udpPacket.SetDestinationPort(session.srcPort)
+	} else if one.dns.intercept && bytes.Equal(srcIP, r.relayIP) && srcPort == one.dns.port {
+		// dns answer of intercepted query
+		session := r.dnsNat.getSession(dstPort)
+		if session == nil {
+			logger.Debugf("[udp] %s:%d > %s:%d: no dns session", srcIP, srcPort, dstIP, dstPort)
+			return
+		}
+		ipPacket.SetSourceIP(session.dstIP)
+		ipPacket.SetDestinationIP(session.srcIP)
+		udpPacket.SetSourcePort(session.dstPort)
+		udpPacket.SetDestinationPort(session.srcPort)
+	} else if one.dns.intercept && dstPort == dnsDefaultPort && !bytes.Equal(srcIP, r.relayIP) {
+		// redirect dns query to dns server, upstream queries of kone itself are relayed
+		isNew, port := r.dnsNat.allocSession(srcIP, dstIP, srcPort, dstPort)
+
+		ipPacket.SetSourceIP(dstIP)
+		udpPacket.SetSourcePort(port)
+		ipPacket.SetDestinationIP(r.relayIP)
+		udpPacket.SetDestinationPort(one.dns.port)
+
+		if isNew {
+			logger.Debugf("[udp] %s:%d > %s:%d: intercept dns to %s:%d > %s:%d",
+				srcIP, srcPort, dstIP, dstPort, dstIP, port, r.relayIP, one.dns.port)
+		}
 	} else if one.dnsTable.Contains(dstIP) { // is fake ip
 		// redirect to relay
 		isNew, port := r.nat.allocSession(srcIP, dstIP, srcPort, dstPort)
@@ -264,8 +345,10 @@ func NewUDPRelay(one *One, cfg NatConfig) *UDPRelay {
 	r := new(UDPRelay)
 	r.one = one
 	r.nat = NewNat(cfg.NatPortStart, cfg.NatPortEnd)
+	r.dnsNat = NewNat(cfg.NatPortStart, cfg.NatPortEnd)
 	r.relayIP = one.ip
 	r.relayPort = cfg.ListenPort
 	r.tunnels = make(map[string]*UDPTunnel)
+	r.dialing = make(map[string]chan struct{})
 	return r
 }
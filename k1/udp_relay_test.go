@@ -0,0 +1,74 @@
+package k1
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nxsre/kone/tcpip"
+)
+
+func TestUDPRelayInterceptDns(t *testing.T) {
+	one := testRelayOne()
+	relay := NewUDPRelay(one, NatConfig{ListenPort: 82, NatPortStart: 10000, NatPortEnd: 10100})
+	nameserver := net.ParseIP("8.8.8.8")
+
+	// query of client is redirected to dns server
+	var buf bytes.Buffer
+	relay.Filter(&buf, testIPv4Packet(tcpip.UDP, net.ParseIP("192.168.1.2"), nameserver, 40000, 53))
+	packet := tcpip.IPv4Packet(buf.Bytes())
+	if port := tcpip.UDPPacket(packet.Payload()).DestinationPort(); !packet.DestinationIP().Equal(one.ip) || port != 5353 {
+		t.Errorf("query of client: %s:%d", packet.DestinationIP(), port)
+	}
+
+	// upstream query of kone is relayed, not looped back
+	buf.Reset()
+	relay.Filter(&buf, testIPv4Packet(tcpip.UDP, one.ip, nameserver, 40001, 53))
+	packet = tcpip.IPv4Packet(buf.Bytes())
+	if port := tcpip.UDPPacket(packet.Payload()).DestinationPort(); port != 82 {
+		t.Errorf("upstream query: %s:%d", packet.DestinationIP(), port)
+	}
+	if relay.dnsNat.count() != 1 {
+		t.Errorf("dns sessions: %d", relay.dnsNat.count())
+	}
+}
+
+func TestUDPRelayGrabTunnelPerClient(t *testing.T) {
+	one := testRelayOne()
+	one.rules = NewRuleSet(RuleConfig{}, nil, nil)
+	relay := NewUDPRelay(one, NatConfig{ListenPort: 82, NatPortStart: 10000, NatPortEnd: 10100})
+	a := &net.UDPAddr{IP: one.ip, Port: 10001}
+	b := &net.UDPAddr{IP: one.ip, Port: 10002}
+
+	// tunnel of a is being dialed
+	dialing := make(chan struct{})
+	relay.dialing[a.String()] = dialing
+
+	done := make(chan struct{})
+	go func() {
+		relay.grabTunnel(nil, b)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("other client should not wait")
+	}
+
+	done = make(chan struct{})
+	go func() {
+		relay.grabTunnel(nil, a)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("packet of client should wait for its tunnel")
+	case <-time.After(100 * time.Millisecond):
+	}
+	relay.lock.Lock()
+	delete(relay.dialing, a.String())
+	relay.lock.Unlock()
+	close(dialing)
+	<-done
+}